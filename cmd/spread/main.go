@@ -2,12 +2,14 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	mrand "math/rand"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 
 	"github.com/niemeyer/pretty"
@@ -30,6 +32,15 @@ var (
 	abend       = flag.Bool("abend", false, "Stop without restoring on first error")
 	restore     = flag.Bool("restore", false, "Run only the restore scripts")
 	discard     = flag.Bool("discard", false, "Discard reused servers without running")
+	junit       = flag.String("junit", "", "Write JUnit XML report of the run to the given file")
+	jsonEvents  = flag.Bool("json-events", false, "Write JSON events to stdout and log to stderr")
+	logs        = flag.String("logs", "", "Write output of scripts for each job into files under the given directory")
+	artifacts   = flag.String("artifacts", "", "Fetch artifacts of each job into the given directory")
+	retries     = flag.Int("retries", 0, "Retry failed tasks up to the given number of times")
+	retryFresh  = flag.Bool("retry-fresh", false, "Retry failed tasks on freshly allocated servers")
+	shard       = flag.String("shard", "", "Run only the i-th of n shards of the selected jobs, as i/n")
+	shardTimes  = flag.String("shard-timings", "", "Balance shards by the job timings in the given file")
+	rerunFailed = flag.Bool("rerun-failed", false, "Run only the jobs that failed or were aborted in the last run")
 )
 
 func main() {
@@ -43,7 +54,11 @@ func run() error {
 	mrand.Seed(time.Now().UnixNano())
 	flag.Parse()
 
-	spread.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	if *jsonEvents {
+		spread.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	} else {
+		spread.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
 	spread.Verbose = *verbose
 	spread.Debug = *vverbose
 
@@ -56,6 +71,10 @@ func run() error {
 		other = other || b
 	}
 
+	if *retries < 0 {
+		return fmt.Errorf("cannot have negative -retries")
+	}
+
 	password := *pass
 	if password == "" {
 		buf := make([]byte, 8)
@@ -66,8 +85,12 @@ func run() error {
 		password = fmt.Sprintf("%x", buf)
 	}
 
+	project, err := spread.Load(".")
+	if err != nil {
+		return err
+	}
+
 	var filter spread.Filter
-	var err error
 	if args := flag.Args(); len(args) > 0 {
 		filter, err = spread.NewFilter(args)
 		if err != nil {
@@ -75,6 +98,21 @@ func run() error {
 		}
 	}
 
+	if *rerunFailed {
+		lastRun, err := spread.ReadLastRun(project)
+		if err != nil {
+			return err
+		}
+		if len(lastRun.Failed()) == 0 {
+			return fmt.Errorf("no jobs failed or were aborted in the last run")
+		}
+		if filter != nil {
+			filter = bothFilters{lastRun.Filter(), filter}
+		} else {
+			filter = lastRun.Filter()
+		}
+	}
+
 	options := &spread.Options{
 		Password:    password,
 		Filter:      filter,
@@ -88,14 +126,46 @@ func run() error {
 		Abend:       *abend,
 		Restore:     *restore,
 		Discard:     *discard,
+		JUnit:       *junit,
+		Logs:        *logs,
+		Artifacts:   *artifacts,
+		Retries:     *retries,
+		RetryFresh:  *retryFresh,
 	}
 
-	project, err := spread.Load(".")
-	if err != nil {
-		return err
+	if *shard != "" {
+		options.Shard, options.Shards, err = parseShard(*shard)
+		if err != nil {
+			return err
+		}
+		options.ShardTimings = *shardTimes
+	} else if *shardTimes != "" {
+		return fmt.Errorf("cannot use -shard-timings without -shard")
+	}
+
+	if *jsonEvents {
+		encoder := json.NewEncoder(os.Stdout)
+		options.Events = func(ev spread.Event) {
+			if err := encoder.Encode(ev); err != nil {
+				printf("Error writing JSON event: %v", err)
+			}
+		}
 	}
 
 	if *list {
+		if options.Shards > 0 {
+			// List the whole partition so it's clear where each job lands.
+			shards, err := project.Shards(options)
+			if err != nil {
+				return err
+			}
+			for i, jobs := range shards {
+				for _, job := range jobs {
+					fmt.Printf("%d/%d %s\n", i+1, options.Shards, job.Name)
+				}
+			}
+			return nil
+		}
 		jobs, err := project.Jobs(options)
 		if err != nil {
 			return err
@@ -131,6 +201,26 @@ func printf(format string, v ...interface{}) {
 	}
 }
 
+// bothFilters passes only the jobs that pass both of its filters.
+type bothFilters [2]spread.Filter
+
+func (f bothFilters) Pass(job *spread.Job) bool {
+	return f[0].Pass(job) && f[1].Pass(job)
+}
+
+func parseShard(s string) (shard, shards int, err error) {
+	if i := strings.Index(s, "/"); i > 0 {
+		shard, err = strconv.Atoi(s[:i])
+		if err == nil {
+			shards, err = strconv.Atoi(s[i+1:])
+		}
+		if err == nil && shard >= 1 && shard <= shards {
+			return shard, shards, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid -shard value %q, expected i/n with 1 <= i <= n", s)
+}
+
 func parseReuseEntry(entry string) (backend string, addrs []string) {
 	if i := strings.Index(entry, ":"); i > 0 {
 		return entry[:i], strings.Split(entry[i+1:], ",")
@@ -7,6 +7,12 @@ import (
 	"strings"
 )
 
+func init() {
+	RegisterProvider("adhoc", AdHoc)
+	RegisterValidator("adhoc", validateAdHoc)
+	RegisterFields("adhoc", "allocate", "discard")
+}
+
 func AdHoc(p *Project, b *Backend, o *Options) Provider {
 	return &adhocProvider{p, b, o}
 }
@@ -17,6 +23,13 @@ type adhocProvider struct {
 	options *Options
 }
 
+func validateAdHoc(p *Project, b *Backend) error {
+	if strings.TrimSpace(b.Allocate) == "" {
+		return fmt.Errorf("%s requires an allocate field", b)
+	}
+	return nil
+}
+
 type adhocServer struct {
 	p *adhocProvider
 
@@ -103,6 +116,9 @@ func (p *adhocProvider) run(script string, system *System, address string) (resu
 	if system.Password == "" {
 		env.Set("SPREAD_PASSWORD", p.options.Password)
 	}
+	if p.options.PublicKey != "" {
+		env.Set("SPREAD_PUBLIC_KEY", p.options.PublicKey)
+	}
 	lscript := localScript{
 		script:      script,
 		dir:         p.project.Path,
@@ -0,0 +1,86 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type ArtifactsSuite struct {
+	dir string
+}
+
+var _ = Suite(&ArtifactsSuite{})
+
+func (s *ArtifactsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ArtifactsSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *ArtifactsSuite) TestArtifacts(c *C) {
+	injected := filepath.Join(s.dir, "injected")
+	s.write(c, "spread.yaml", `
+project: artifacts-test
+path: /spread-artifacts-test
+backends:
+    local:
+        temp-dir: true
+        systems:
+            - local-host
+suites:
+    tests/:
+        summary: Local tests
+    broken/:
+        summary: Broken suite
+        prepare: |
+            echo prepared > $SPREAD_PATH/broken/task/prepare.log
+            exit 1
+`)
+	s.write(c, "tests/task/task.yaml", `
+summary: Task with odd artifact patterns
+artifacts:
+    - out*
+    - with space
+    - '$(touch `+injected+`)'
+    - 'a"b;c'
+execute: |
+    echo out > output
+    echo space > "with space"
+    echo quote > 'a"b;c'
+`)
+	s.write(c, "broken/task/task.yaml", `
+summary: Task in broken suite
+artifacts: [prepare.log]
+execute: |
+    true
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	artifacts := filepath.Join(s.dir, "artifacts")
+	runner, err := spread.Start(project, &spread.Options{Artifacts: artifacts})
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), ErrorMatches, "unsuccessful run")
+
+	for _, name := range []string{"output", "with space", `a"b;c`} {
+		_, err := os.Stat(filepath.Join(artifacts, "local:local-host:tests/task", name))
+		c.Assert(err, IsNil)
+	}
+	_, err = os.Stat(injected)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// Artifacts are fetched even if the task never ran.
+	data, err := ioutil.ReadFile(filepath.Join(artifacts, "local:local-host:broken/task", "prepare.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "prepared\n")
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
 	"net"
 	"regexp"
@@ -18,41 +19,142 @@ import (
 	"syscall"
 )
 
+// Executor runs scripts and transfers files on a server on behalf of
+// the runner. Client is the executor for servers reached over SSH.
+type Executor interface {
+	Server() Server
+	Close() error
+
+	SetWarnTimeout(timeout time.Duration)
+	SetKillTimeout(timeout time.Duration)
+
+	Trace(script string, dir string, env *Environment) (output []byte, err error)
+	Shell(script string, dir string, env *Environment) error
+
+	RemoveAll(path string) error
+	MissingOrEmpty(dir string) (bool, error)
+	SendTar(tar io.Reader, unpackDir string) error
+	RecvTar(packDir string, include []string, tar io.Writer) error
+}
+
 type Client struct {
 	server Server
 	sshc   *ssh.Client
 	config *ssh.ClientConfig
 	addr   string
+	proxy  ProxyChain
+	agentc net.Conn
+
+	hostKey ssh.PublicKey
 
 	warnTimeout time.Duration
 	killTimeout time.Duration
+
+	notify func(typ string, ev Event)
 }
 
-func Dial(server Server, username, password string) (*Client, error) {
+// Dial connects to server over SSH as username, authenticating with
+// the provided keys, the password if not empty, and then the keys held
+// by the SSH agent at $SSH_AUTH_SOCK, if any, in that order.
+//
+// The host key of the server is verified with hostKey, or accepted
+// on first use if hostKey is nil. Either way, the same host key is
+// required when reconnecting later on, such as after reboots.
+//
+// The connection goes through the jump hosts of the server system,
+// if it has any.
+func Dial(server Server, username, password string, hostKey ssh.HostKeyCallback, keys ...ssh.Signer) (*Client, error) {
+	if hostKey == nil {
+		hostKey = ssh.InsecureIgnoreHostKey()
+	}
+	var seen ssh.PublicKey
+	var keyErr error
 	config := &ssh.ClientConfig{
 		User:    username,
-		Auth:    []ssh.AuthMethod{ssh.Password(password)},
 		Timeout: 10 * time.Second,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := hostKey(hostname, remote, key); err != nil {
+				keyErr = err
+				return err
+			}
+			seen = key
+			return nil
+		},
+	}
+	if len(keys) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(keys...))
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	var agentc net.Conn
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			debugf("Cannot connect to SSH agent: %v", err)
+		} else {
+			agentc = conn
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
 	}
 	addr := server.Address()
 	if !strings.Contains(addr, ":") {
 		addr += ":22"
 	}
-	sshc, err := ssh.Dial("tcp", addr, config)
+	var proxy ProxyChain
+	if system := server.System(); system != nil {
+		proxy = system.Proxy
+	}
+	sshc, err := sshDial(proxy, addr, config)
 	if err != nil {
-		return nil, fmt.Errorf("cannot connect to %s: %v", server, err)
+		if agentc != nil {
+			agentc.Close()
+		}
+		err = fmt.Errorf("cannot connect to %s: %v", server, err)
+		if keyErr != nil {
+			return nil, &HostKeyError{err}
+		}
+		return nil, err
 	}
+	config.HostKeyCallback = ssh.FixedHostKey(seen)
 	client := &Client{
 		server: server,
 		sshc:   sshc,
 		config: config,
 		addr:   addr,
+		proxy:  proxy,
+		agentc: agentc,
+
+		hostKey: seen,
 	}
 	client.SetWarnTimeout(0)
 	client.SetKillTimeout(0)
 	return client, nil
 }
 
+// HostKeyError reports that the host key presented by a server could
+// not be verified, which retrying the connection won't fix.
+type HostKeyError struct{ error }
+
+// redial connects to the server again, reporting a host key that
+// doesn't match the one seen at first as a HostKeyError.
+func (c *Client) redial() (*ssh.Client, error) {
+	var keyErr error
+	config := *c.config
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := c.config.HostKeyCallback(hostname, remote, key); err != nil {
+			keyErr = err
+			return err
+		}
+		return nil
+	}
+	sshc, err := sshDial(c.proxy, c.addr, &config)
+	if err != nil && keyErr != nil {
+		return nil, &HostKeyError{fmt.Errorf("cannot reconnect to %s: %v", c.server, err)}
+	}
+	return sshc, err
+}
+
 func (c *Client) dialOnReboot() error {
 	// First wait until SSH isn't working anymore.
 	timeout := time.After(c.killTimeout)
@@ -65,7 +167,7 @@ func (c *Client) dialOnReboot() error {
 	waitConfig.Timeout = 5 * time.Second
 	for {
 		before := time.Now()
-		sshc, err := ssh.Dial("tcp", c.addr, &waitConfig)
+		sshc, err := sshDial(c.proxy, c.addr, &waitConfig)
 		if err != nil {
 			// It's gone.
 			break
@@ -87,12 +189,15 @@ func (c *Client) dialOnReboot() error {
 
 	// Then wait for it to come back up.
 	for {
-		sshc, err := ssh.Dial("tcp", c.addr, c.config)
+		sshc, err := c.redial()
 		if err == nil {
 			c.sshc.Close()
 			c.sshc = sshc
 			return nil
 		}
+		if _, ok := err.(*HostKeyError); ok {
+			return err
+		}
 		select {
 		case <-retry.C:
 		case <-relog.C:
@@ -103,7 +208,52 @@ func (c *Client) dialOnReboot() error {
 	}
 }
 
+// reconnect drops the current connection and dials the server again,
+// waiting for it to come back if necessary. It is used after the server
+// state is replaced underneath the connection, such as when a snapshot
+// is restored.
+func (c *Client) reconnect() error {
+	c.sshc.Close()
+
+	timeout := time.After(5 * time.Minute)
+	relog := time.NewTicker(15 * time.Second)
+	defer relog.Stop()
+	retry := time.NewTicker(1 * time.Second)
+	defer retry.Stop()
+
+	for {
+		sshc, err := c.redial()
+		if err == nil {
+			c.sshc = sshc
+			return nil
+		}
+		if _, ok := err.(*HostKeyError); ok {
+			return err
+		}
+		select {
+		case <-retry.C:
+		case <-relog.C:
+			printf("Cannot reconnect to %s: %v", c.server, err)
+		case <-timeout:
+			return fmt.Errorf("cannot reconnect to %s: %v", c.server, err)
+		}
+	}
+}
+
+func (c *Client) event(typ string, output []byte) {
+	if c.notify != nil {
+		c.notify(typ, &ClientEvent{
+			Server:  c.server.String(),
+			Address: c.server.Address(),
+			Output:  string(output),
+		})
+	}
+}
+
 func (c *Client) Close() error {
+	if c.agentc != nil {
+		c.agentc.Close()
+	}
 	return c.sshc.Close()
 }
 
@@ -111,6 +261,11 @@ func (c *Client) Server() Server {
 	return c.server
 }
 
+// HostKey returns the host key presented by the server when connecting.
+func (c *Client) HostKey() ssh.PublicKey {
+	return c.hostKey
+}
+
 func (c *Client) SetWarnTimeout(timeout time.Duration) {
 	if timeout == 0 {
 		timeout = defaultWarnTimeout
@@ -261,6 +416,7 @@ func (c *Client) run(script string, dir string, env *Environment, mode outputMod
 		}
 
 		printf("Rebooting %s as requested...", c.server)
+		c.event(RebootRequested, nil)
 
 		rebootKey = rerr.Key
 		output = append(output, '\n')
@@ -292,6 +448,10 @@ var toBashRC = map[string]bool{
 	"SPREAD_SYSTEM":  true,
 }
 
+// matchFunc defines the MATCH shell function available to scripts
+// and interactive shells.
+const matchFunc = "MATCH() { { set +xu; } 2> /dev/null; [ ${#@} -gt 0 ] || { echo \"error: missing regexp argument\"; return 1; }; local stdin=\"$(cat)\"; echo $stdin | grep -q -e \"$@\" || { echo \"error: pattern not found, got:\n$stdin\">&2; return 1; }; }\n"
+
 func (c *Client) runPart(script string, dir string, env *Environment, mode outputMode, previous []byte) (output []byte, err error) {
 	script = strings.TrimSpace(script)
 	if len(script) == 0 && mode != shellOutput {
@@ -326,7 +486,7 @@ func (c *Client) runPart(script string, dir string, env *Environment, mode outpu
 	}
 	buf.WriteString(rc(false, "REBOOT() { { set +xu; } 2> /dev/null; [ -z \"$1\" ] && echo '<REBOOT>' || echo \"<REBOOT $1>\"; exit 213; }\n"))
 	buf.WriteString(rc(false, "ERROR() { { set +xu; } 2> /dev/null; [ -z \"$1\" ] && echo '<ERROR>' || echo \"<ERROR $@>\"; exit 213; }\n"))
-	buf.WriteString(rc(true, "MATCH() { { set +xu; } 2> /dev/null; [ ${#@} -gt 0 ] || { echo \"error: missing regexp argument\"; return 1; }; local stdin=\"$(cat)\"; echo $stdin | grep -q -e \"$@\" || { echo \"error: pattern not found, got:\n$stdin\">&2; return 1; }; }\n"))
+	buf.WriteString(rc(true, matchFunc))
 	buf.WriteString("export DEBIAN_FRONTEND=noninteractive\n")
 	buf.WriteString("export DEBIAN_PRIORITY=critical\n")
 	buf.WriteString("export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n")
@@ -475,9 +635,20 @@ func (c *Client) RemoveAll(path string) error {
 	return err
 }
 
-func (c *Client) SetupRootAccess(password string) error {
+// SetupRootAccess sets the root password and enables root logins over
+// SSH. If publicKey is not empty, it is authorized for root logins in
+// place of setting the password and enabling logins with it.
+func (c *Client) SetupRootAccess(password, publicKey string) error {
 	var script string
-	if c.config.User == "root" {
+	if publicKey != "" && c.config.User == "root" {
+		script = authorizeKeyScript(publicKey)
+	} else if publicKey != "" {
+		script = strings.Join([]string{
+			`sudo /bin/bash -c ` + shellQuote(authorizeKeyScript(publicKey)),
+			`sudo sed -i 's/^\(PermitRootLogin\)\s\+no\>.*/\1 prohibit-password/' /etc/ssh/sshd_config`,
+			`sudo pkill -o -HUP sshd || true`,
+		}, "\n")
+	} else if c.config.User == "root" {
 		script = fmt.Sprintf(`echo root:'%s' | chpasswd`, password)
 	} else {
 		script = strings.Join([]string{
@@ -490,7 +661,7 @@ func (c *Client) SetupRootAccess(password string) error {
 	if err != nil {
 		return fmt.Errorf("cannot setup root access: %s", err)
 	}
-	if c.config.User == "root" {
+	if c.config.User == "root" && publicKey == "" {
 		c.config.Auth = []ssh.AuthMethod{ssh.Password(password)}
 	}
 	return nil
@@ -537,6 +708,8 @@ func (c *Client) Send(from, to string, include, exclude []string) error {
 	args := []string{
 		"-cz",
 		"--exclude=.spread-reuse.*",
+		"--exclude=.spread-last-run.*",
+		"--exclude=.spread-timings.*",
 	}
 	for _, pattern := range exclude {
 		args = append(args, "--exclude="+pattern)
@@ -602,6 +775,42 @@ func (c *Client) SendTar(tar io.Reader, unpackDir string) error {
 	return nil
 }
 
+// recvTarScript packs the files matching the glob patterns in its
+// arguments, relative to the directory in its first argument. The
+// patterns are expanded as globs only, so they are never split on
+// spaces nor evaluated as shell code.
+const recvTarScript = `cd "$1" && shift && shopt -s nullglob && IFS= && files=() && for p in "$@"; do files+=($p); done && /bin/tar cz --ignore-failed-read -T /dev/null -- "${files[@]}"`
+
+// shellQuote returns s quoted for use as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// RecvTar packs the files and directories on the server matching the
+// include glob patterns, relative to packDir, and writes them into tar
+// in tar.gz format. Patterns that match nothing are ignored.
+func (c *Client) RecvTar(packDir string, include []string, tar io.Writer) error {
+	session, err := c.sshc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr safeBuffer
+	session.Stdout = tar
+	session.Stderr = &stderr
+	args := []string{shellQuote(recvTarScript), "--", shellQuote(packDir)}
+	for _, pattern := range include {
+		args = append(args, shellQuote(pattern))
+	}
+	cmd := fmt.Sprintf(`%s/bin/bash -c %s`, c.sudo(), strings.Join(args, " "))
+	err = c.runCommand(session, cmd, nil, &stderr)
+	if err != nil {
+		return outputErr(stderr.Bytes(), err)
+	}
+	return nil
+}
+
 const (
 	defaultWarnTimeout = 5 * time.Minute
 	defaultKillTimeout = 15 * time.Minute
@@ -653,6 +862,7 @@ func (c *Client) runCommand(session *ssh.Session, cmd string, stdout, stderr io.
 					output = append(output, errput...)
 				}
 			}
+			c.event(WarnTimeout, output)
 			if bytes.Equal(output, unchangedMarker) {
 				printf("WARNING: %s running late. Output unchanged.", c.server)
 			} else if len(output) == 0 {
@@ -909,7 +1119,13 @@ func outputErr(output []byte, err error) error {
 	return err
 }
 
-func waitPortUp(what fmt.Stringer, address string) error {
+func waitPortUp(system *System, address string) error {
+	return waitPortUpOrAbort(system, address, nil)
+}
+
+// waitPortUpOrAbort works like waitPortUp, but gives up as soon as
+// an error is received from abort, and returns it.
+func waitPortUpOrAbort(system *System, address string, abort <-chan error) error {
 	if !strings.Contains(address, ":") {
 		address += ":22"
 	}
@@ -921,7 +1137,7 @@ func waitPortUp(what fmt.Stringer, address string) error {
 	defer retry.Stop()
 
 	for {
-		conn, err := net.Dial("tcp", address)
+		conn, err := dialPort(system.Proxy, address)
 		if err == nil {
 			conn.Close()
 			break
@@ -929,9 +1145,11 @@ func waitPortUp(what fmt.Stringer, address string) error {
 		select {
 		case <-retry.C:
 		case <-relog.C:
-			printf("Cannot connect to %s: %v", what, err)
+			printf("Cannot connect to %s: %v", system, err)
 		case <-timeout:
-			return fmt.Errorf("cannot connect to %s: %v", what, err)
+			return fmt.Errorf("cannot connect to %s: %v", system, err)
+		case err := <-abort:
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,224 @@
+package spread_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/snapcore/spread/spread"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "gopkg.in/check.v1"
+)
+
+type ClientSuite struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	key      ssh.Signer
+	hostKey  ssh.Signer
+	sock     string
+	tunnels  int32
+}
+
+var _ = Suite(&ClientSuite{})
+
+func newKey(c *C) ssh.Signer {
+	pkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	key, err := ssh.NewSignerFromKey(pkey)
+	c.Assert(err, IsNil)
+	return key
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+}
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	s.sock = os.Getenv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	s.key = newKey(c)
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "jump" && string(password) == "bastion" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(s.key.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}
+	s.hostKey = newKey(c)
+	s.config.AddHostKey(s.hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+	s.tunnels = 0
+	go s.serve()
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	s.listener.Close()
+	os.Setenv("SSH_AUTH_SOCK", s.sock)
+}
+
+func (s *ClientSuite) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for ch := range chans {
+				if ch.ChannelType() == "direct-tcpip" {
+					go s.forward(ch)
+					continue
+				}
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+			sconn.Close()
+		}()
+	}
+}
+
+// forward serves a port forwarding request as done for jump hosts.
+func (s *ClientSuite) forward(ch ssh.NewChannel) {
+	var msg struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(ch.ExtraData(), &msg); err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))))
+	if err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := ch.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.tunnels, 1)
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+func (s *ClientSuite) server() spread.Server {
+	return &spread.UnknownServer{Addr: s.listener.Addr().String()}
+}
+
+func (s *ClientSuite) TestDialKey(c *C) {
+	_, err := spread.Dial(s.server(), "root", "secret", nil)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: ssh: handshake failed: .*unable to authenticate.*")
+
+	_, err = spread.Dial(s.server(), "root", "secret", nil, newKey(c))
+	c.Assert(err, ErrorMatches, "cannot connect to .*unable to authenticate.*")
+
+	client, err := spread.Dial(s.server(), "root", "", nil, newKey(c), s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.Close(), IsNil)
+}
+
+func (s *ClientSuite) TestDialHostKey(c *C) {
+	client, err := spread.Dial(s.server(), "root", "", nil, s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.HostKey().Marshal(), DeepEquals, s.hostKey.PublicKey().Marshal())
+	c.Assert(client.Close(), IsNil)
+
+	client, err = spread.Dial(s.server(), "root", "", ssh.FixedHostKey(s.hostKey.PublicKey()), s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.Close(), IsNil)
+
+	_, err = spread.Dial(s.server(), "root", "", ssh.FixedHostKey(newKey(c).PublicKey()), s.key)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: ssh: handshake failed: ssh: host key mismatch")
+}
+
+type proxiedServer struct {
+	spread.UnknownServer
+	system *spread.System
+}
+
+func (s *proxiedServer) System() *spread.System { return s.system }
+
+func (s *ClientSuite) TestDialProxy(c *C) {
+	// The fake server is its own jump host, so the number of
+	// forwarded connections tells how many hops were taken.
+	addr := s.listener.Addr().String()
+	hostKey := authorizedKey(s.hostKey.PublicKey())
+	proxy := spread.ProxyChain{{Address: addr, Username: "jump", Password: "bastion", HostKey: hostKey}}
+	server := &proxiedServer{spread.UnknownServer{Addr: addr}, &spread.System{Name: "proxied-system", Proxy: proxy}}
+
+	client, err := spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.Close(), IsNil)
+	c.Assert(atomic.LoadInt32(&s.tunnels), Equals, int32(1))
+
+	server.system.Proxy = append(proxy, &spread.ProxyHost{Address: addr, Username: "jump", Password: "bastion", HostKey: hostKey})
+	client, err = spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.Close(), IsNil)
+	c.Assert(atomic.LoadInt32(&s.tunnels), Equals, int32(3))
+
+	server.system.Proxy = spread.ProxyChain{{Address: addr, Username: "jump", Password: "wrong", HostKey: hostKey}}
+	_, err = spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: cannot connect to proxy .*unable to authenticate.*")
+}
+
+func (s *ClientSuite) TestDialProxyHostKey(c *C) {
+	addr := s.listener.Addr().String()
+	host := &spread.ProxyHost{Address: addr, Username: "jump", Password: "bastion"}
+	server := &proxiedServer{spread.UnknownServer{Addr: addr}, &spread.System{Name: "proxied-system", Proxy: spread.ProxyChain{host}}}
+
+	_, err := spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: cannot verify host key of proxy .*: no host-key or known-hosts defined")
+
+	host.HostKey = authorizedKey(newKey(c).PublicKey())
+	_, err = spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: cannot connect to proxy .*: ssh: handshake failed: ssh: host key mismatch")
+
+	// Without host-key, the jump host is verified with known-hosts.
+	host.HostKey = ""
+	host.KnownHosts = filepath.Join(c.MkDir(), "known_hosts")
+	line := knownhosts.Line([]string{addr}, s.hostKey.PublicKey())
+	c.Assert(ioutil.WriteFile(host.KnownHosts, []byte(line+"\n"), 0644), IsNil)
+	client, err := spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, IsNil)
+	c.Assert(client.Close(), IsNil)
+
+	line = knownhosts.Line([]string{addr}, newKey(c).PublicKey())
+	c.Assert(ioutil.WriteFile(host.KnownHosts, []byte(line+"\n"), 0644), IsNil)
+	_, err = spread.Dial(server, "root", "", nil, s.key)
+	c.Assert(err, ErrorMatches, "cannot connect to .*: cannot connect to proxy .*: ssh: handshake failed: knownhosts: key mismatch")
+}
@@ -0,0 +1,113 @@
+package spread
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+type cloudConfig struct {
+	Hostname    string           `yaml:"hostname"`
+	SSHPwauth   bool             `yaml:"ssh_pwauth"`
+	DisableRoot bool             `yaml:"disable_root"`
+	Chpasswd    cloudChpasswd    `yaml:"chpasswd,omitempty"`
+	WriteFiles  []cloudWriteFile `yaml:"write_files,omitempty"`
+	Runcmd      []string         `yaml:"runcmd"`
+}
+
+type cloudChpasswd struct {
+	Expire bool   `yaml:"expire"`
+	List   string `yaml:"list"`
+}
+
+type cloudWriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+}
+
+type cloudMetaData struct {
+	InstanceID    string `yaml:"instance-id"`
+	LocalHostname string `yaml:"local-hostname"`
+}
+
+// cloudInitSeed writes into dir a NoCloud cloud-init seed image that
+// authorizes publicKey for root logins over SSH if not empty, or that
+// otherwise enables root login over SSH with password, and returns its
+// path. Password logins are also enabled for the system credentials, if
+// defined. Stock cloud images may then be used as if prepared for spread.
+// The path is empty if no tool for creating the image is available.
+func cloudInitSeed(dir, hostname string, system *System, password, publicKey string) (string, error) {
+	config := &cloudConfig{
+		Hostname:    hostname,
+		DisableRoot: false,
+	}
+	if publicKey != "" {
+		config.Runcmd = append(config.Runcmd, authorizeKeyScript(publicKey))
+	}
+	if publicKey == "" || system.Password != "" {
+		var users string
+		if publicKey == "" {
+			users = "root:" + password + "\n"
+		}
+		if system.Password != "" {
+			if system.Username == "" || system.Username == "root" {
+				users = "root:" + system.Password + "\n"
+			} else {
+				users += system.Username + ":" + system.Password + "\n"
+			}
+		}
+		config.SSHPwauth = true
+		config.Chpasswd = cloudChpasswd{List: users}
+		config.WriteFiles = []cloudWriteFile{{
+			Path:        "/etc/ssh/sshd_config.d/00-spread.conf",
+			Content:     "PermitRootLogin yes\nPasswordAuthentication yes\n",
+			Permissions: "0644",
+		}}
+		config.Runcmd = append(config.Runcmd,
+			`sed -i 's/^#\?\(PermitRootLogin\|PasswordAuthentication\)\>.*/\1 yes/' /etc/ssh/sshd_config`,
+			"systemctl restart ssh || systemctl restart sshd || service ssh restart",
+		)
+	}
+	userData, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("internal error: cannot marshal cloud-init user data: %v", err)
+	}
+	metaData, err := yaml.Marshal(&cloudMetaData{InstanceID: hostname, LocalHostname: hostname})
+	if err != nil {
+		return "", fmt.Errorf("internal error: cannot marshal cloud-init meta data: %v", err)
+	}
+
+	userPath := filepath.Join(dir, "user-data")
+	metaPath := filepath.Join(dir, "meta-data")
+	seedPath := filepath.Join(dir, "seed.iso")
+	if err := ioutil.WriteFile(userPath, append([]byte("#cloud-config\n"), userData...), 0600); err != nil {
+		return "", fmt.Errorf("cannot write cloud-init user data: %v", err)
+	}
+	if err := ioutil.WriteFile(metaPath, metaData, 0600); err != nil {
+		return "", fmt.Errorf("cannot write cloud-init meta data: %v", err)
+	}
+
+	mkisofs := []string{"-output", seedPath, "-volid", "cidata", "-joliet", "-rock", userPath, metaPath}
+	tools := [][]string{
+		append([]string{"genisoimage"}, mkisofs...),
+		append([]string{"mkisofs"}, mkisofs...),
+		append([]string{"xorriso", "-as", "mkisofs"}, mkisofs...),
+		{"cloud-localds", seedPath, userPath, metaPath},
+	}
+	for _, args := range tools {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("cannot create cloud-init seed image: %v", outputErr(output, err))
+		}
+		return seedPath, nil
+	}
+	printf("Cannot find genisoimage, mkisofs, xorriso, or cloud-localds; %s will boot without a cloud-init seed.", system)
+	return "", nil
+}
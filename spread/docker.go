@@ -0,0 +1,201 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterProvider("docker", Docker)
+	RegisterValidator("docker", validateDocker)
+	RegisterFields("docker", "engine")
+}
+
+func Docker(p *Project, b *Backend, o *Options) Provider {
+	return &dockerProvider{p, b, o}
+}
+
+type dockerProvider struct {
+	project *Project
+	backend *Backend
+	options *Options
+}
+
+type dockerServer struct {
+	p *dockerProvider
+	d dockerServerData
+
+	system  *System
+	address string
+}
+
+type dockerServerData struct {
+	Name string
+	ID   string
+}
+
+func (s *dockerServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.system, s.d.Name)
+}
+
+func (s *dockerServer) Provider() Provider {
+	return s.p
+}
+
+func (s *dockerServer) Address() string {
+	return s.address
+}
+
+func (s *dockerServer) System() *System {
+	return s.system
+}
+
+func (s *dockerServer) ReuseData() interface{} {
+	return &s.d
+}
+
+func (s *dockerServer) KeyAuthorized() bool {
+	return s.p.options.PublicKey != ""
+}
+
+func (s *dockerServer) Discard() error {
+	output, err := s.p.engine("rm", "--force", s.d.ID).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot discard %s container: %v", s.p.engineName(), outputErr(output, err))
+	}
+	return nil
+}
+
+func (p *dockerProvider) Backend() *Backend {
+	return p.backend
+}
+
+func validateDocker(p *Project, b *Backend) error {
+	switch b.Engine {
+	case "", "docker", "podman":
+	default:
+		return fmt.Errorf("%s has unsupported engine %q", b, b.Engine)
+	}
+	return nil
+}
+
+// engineName returns the command line tool used to manage containers,
+// which is either docker or podman.
+func (p *dockerProvider) engineName() string {
+	if p.backend.Engine != "" {
+		return p.backend.Engine
+	}
+	return "docker"
+}
+
+func (p *dockerProvider) engine(args ...string) *exec.Cmd {
+	return exec.Command(p.engineName(), args...)
+}
+
+func (p *dockerProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error) {
+	s := &dockerServer{
+		p:       p,
+		system:  system,
+		address: rsystem.Address,
+	}
+	err := rsystem.UnmarshalData(&s.d)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal %s reuse data: %v", p.engineName(), err)
+	}
+	return s, nil
+}
+
+func (p *dockerProvider) Allocate(system *System) (Server, error) {
+	name, err := lxdName(system)
+	if err != nil {
+		return nil, err
+	}
+
+	// The image must run sshd by default. Port 22 is published on a
+	// random local port so that it works without routable container
+	// addresses, as is the case with rootless podman.
+	args := []string{"run", "--detach", "--name", name, "--publish", "127.0.0.1::22"}
+	if !p.options.Reuse {
+		args = append(args, "--rm")
+	}
+	args = append(args, system.Image)
+
+	var stderr bytes.Buffer
+	cmd := p.engine(args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, &FatalError{fmt.Errorf("cannot run %s container: %v", p.engineName(), outputErr(stderr.Bytes(), err))}
+	}
+
+	s := &dockerServer{
+		p: p,
+		d: dockerServerData{
+			Name: name,
+			ID:   strings.TrimSpace(string(output)),
+		},
+		system: system,
+	}
+
+	printf("Waiting for %s container %s to have an address...", p.engineName(), name)
+	timeout := time.After(10 * time.Second)
+	retry := time.NewTicker(1 * time.Second)
+	defer retry.Stop()
+	for {
+		addr, err := p.address(s.d.ID)
+		if err == nil {
+			s.address = addr
+			break
+		}
+		select {
+		case <-retry.C:
+		case <-timeout:
+			s.Discard()
+			return nil, err
+		}
+	}
+
+	err = p.tuneSSH(s.d.ID)
+	if err != nil {
+		s.Discard()
+		return nil, err
+	}
+
+	printf("Waiting for %s to make SSH available...", system)
+	if err := waitPortUp(system, s.address); err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("cannot connect to %s: %s", s, err)
+	}
+
+	printf("Allocated %s.", s)
+	return s, nil
+}
+
+// address returns the local address that port 22 of the container
+// is published on.
+func (p *dockerProvider) address(id string) (string, error) {
+	output, err := p.engine("port", id, "22/tcp").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cannot find published SSH port of %s container: %v", p.engineName(), outputErr(output, err))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "127.0.0.1:") {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%s container %s has no published SSH port", p.engineName(), id)
+}
+
+func (p *dockerProvider) tuneSSH(id string) error {
+	err := tuneSSH(func(args []string) ([]byte, error) {
+		return p.engine(append([]string{"exec", id}, args...)...).CombinedOutput()
+	}, p.options.Password, p.options.PublicKey)
+	if err != nil {
+		return fmt.Errorf("cannot prepare sshd in %s container %q: %v", p.engineName(), id, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package spread_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeExec holds fake commands installed in a directory at the front
+// of $PATH. They log their name and arguments before running their
+// script.
+type fakeExec struct {
+	dir  string
+	path string
+}
+
+func newFakeExec(c *C, scripts map[string]string) *fakeExec {
+	f := &fakeExec{dir: c.MkDir(), path: os.Getenv("PATH")}
+	for name, script := range scripts {
+		content := fmt.Sprintf("#!/bin/sh\nfor arg in \"$(basename \"$0\")\" \"$@\"; do printf '%%s\\t' \"$arg\"; done >> %s/log\necho >> %s/log\n%s\n", f.dir, f.dir, script)
+		c.Assert(ioutil.WriteFile(filepath.Join(f.dir, name), []byte(content), 0755), IsNil)
+	}
+	os.Setenv("PATH", f.dir+":"+f.path)
+	return f
+}
+
+func (f *fakeExec) restore() {
+	os.Setenv("PATH", f.path)
+}
+
+// calls returns the commands run so far and forgets about them.
+func (f *fakeExec) calls(c *C) [][]string {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "log"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(filepath.Join(f.dir, "log")), IsNil)
+	var calls [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		calls = append(calls, strings.Split(strings.TrimSuffix(line, "\t"), "\t"))
+	}
+	return calls
+}
+
+type DockerSuite struct {
+	home     string
+	listener net.Listener
+	exec     *fakeExec
+}
+
+var _ = Suite(&DockerSuite{})
+
+func (s *DockerSuite) SetUpTest(c *C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+
+	// Stands for the published SSH port of the container.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+
+	script := fmt.Sprintf(`
+case "$1" in
+run) echo container-id ;;
+port) echo 0.0.0.0:1234; echo %s ;;
+esac
+`, l.Addr())
+	s.exec = newFakeExec(c, map[string]string{"docker": script, "podman": script})
+}
+
+func (s *DockerSuite) TearDownTest(c *C) {
+	s.exec.restore()
+	s.listener.Close()
+	os.Setenv("HOME", s.home)
+}
+
+func (s *DockerSuite) TestAllocateDiscard(c *C) {
+	backend := &spread.Backend{Name: "podman", Type: "docker", Engine: "podman"}
+	system := &spread.System{Backend: "podman", Name: "ubuntu-20.04", Image: "ubuntu:20.04"}
+	provider := spread.Docker(&spread.Project{}, backend, &spread.Options{Password: "secret"})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, s.listener.Addr().String())
+	c.Assert(server.String(), Equals, "podman:ubuntu-20.04 (spread-1-ubuntu-20-04)")
+
+	c.Assert(s.exec.calls(c), DeepEquals, [][]string{
+		{"podman", "run", "--detach", "--name", "spread-1-ubuntu-20-04", "--publish", "127.0.0.1::22", "--rm", "ubuntu:20.04"},
+		{"podman", "port", "container-id", "22/tcp"},
+		{"podman", "exec", "container-id", "sed", "-i", `s/\(PermitRootLogin\|PasswordAuthentication\)\>.*/\1 yes/`, "/etc/ssh/sshd_config"},
+		{"podman", "exec", "container-id", "/bin/bash", "-c", "echo root:'secret' | chpasswd"},
+		{"podman", "exec", "container-id", "killall", "-HUP", "sshd"},
+	})
+
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.exec.calls(c), DeepEquals, [][]string{
+		{"podman", "rm", "--force", "container-id"},
+	})
+}
+
+func (s *DockerSuite) TestAllocateKey(c *C) {
+	backend := &spread.Backend{Name: "docker", Type: "docker"}
+	system := &spread.System{Backend: "docker", Name: "ubuntu-20.04", Image: "ubuntu:20.04"}
+	options := &spread.Options{Password: "secret", PublicKey: "ecdsa-sha2-nistp256 AAAA", Reuse: true}
+	provider := spread.Docker(&spread.Project{}, backend, options)
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.(spread.KeyServer).KeyAuthorized(), Equals, true)
+
+	// Reused containers are not removed once stopped, and password
+	// logins are left alone.
+	calls := s.exec.calls(c)
+	c.Assert(calls, HasLen, 3)
+	c.Assert(calls[0], DeepEquals, []string{"docker", "run", "--detach", "--name", "spread-1-ubuntu-20-04", "--publish", "127.0.0.1::22", "ubuntu:20.04"})
+	c.Assert(calls[2][:5], DeepEquals, []string{"docker", "exec", "container-id", "/bin/bash", "-c"})
+	c.Assert(calls[2][5], Matches, `.*echo 'ecdsa-sha2-nistp256 AAAA' >> /root/.ssh/authorized_keys.*`)
+}
+
+func (s *DockerSuite) TestUnsupportedEngine(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(dir, "tests"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "spread.yaml"), []byte(`
+project: docker-test
+path: /docker-test
+backends:
+    docker:
+        engine: rkt
+        systems: [ubuntu-20.04]
+suites:
+    tests/:
+        summary: Tests
+`), 0644), IsNil)
+	_, err := spread.Load(dir)
+	c.Assert(err, ErrorMatches, `backend "docker" has unsupported engine "rkt"`)
+}
@@ -0,0 +1,172 @@
+package spread
+
+import (
+	"time"
+)
+
+// Event is implemented by all the values delivered to Options.Events
+// while a run makes progress. The event details are available by type
+// switching on the concrete event types defined in this file, and the
+// Type field of the embedded EventInfo tells which event took place.
+type Event interface {
+	info() *EventInfo
+}
+
+// EventInfo holds the details that are common to all events.
+type EventInfo struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+}
+
+func (info *EventInfo) info() *EventInfo { return info }
+
+// Event types reported via EventInfo.Type.
+const (
+	ServerAllocated = "server-allocated"
+	ServerReused    = "server-reused"
+	ServerDiscarded = "server-discarded"
+	ContentSent     = "content-sent"
+	PrepareStarted  = "prepare-started"
+	PrepareFinished = "prepare-finished"
+	ExecuteStarted  = "execute-started"
+	ExecuteFinished = "execute-finished"
+	RestoreStarted  = "restore-started"
+	RestoreFinished = "restore-finished"
+	RebootRequested = "reboot-requested"
+	WarnTimeout     = "warn-timeout"
+	RunFinished     = "run-finished"
+)
+
+// ServerEvent reports changes in the state of a server. Its type is one
+// of ServerAllocated, ServerReused, ServerDiscarded, or ContentSent.
+type ServerEvent struct {
+	EventInfo
+	Backend string `json:"backend"`
+	System  string `json:"system"`
+	Server  string `json:"server"`
+	Address string `json:"address"`
+}
+
+// ScriptEvent reports a prepare, execute, or restore script starting
+// or finishing to run on a server. Level is one of "project", "backend",
+// "suite", or "task", and defines which of those the script belongs to.
+// Error is only set for finished scripts that failed.
+type ScriptEvent struct {
+	EventInfo
+	Job     string `json:"job"`
+	Level   string `json:"level"`
+	Context string `json:"context"`
+	Server  string `json:"server"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ClientEvent reports something that happened on a server while it
+// was running a script. Its type is either RebootRequested or WarnTimeout.
+// For the latter, Output holds the output of the script so far.
+type ClientEvent struct {
+	EventInfo
+	Server  string `json:"server"`
+	Address string `json:"address"`
+	Output  string `json:"output,omitempty"`
+}
+
+// StatsEvent reports the final results of a run, with job names
+// organized by outcome. Its type is RunFinished.
+type StatsEvent struct {
+	EventInfo
+	TaskDone            []string `json:"task-done"`
+	TaskFlaky           []string `json:"task-flaky"`
+	TaskError           []string `json:"task-error"`
+	TaskAbort           []string `json:"task-abort"`
+	TaskPrepareError    []string `json:"task-prepare-error"`
+	TaskRestoreError    []string `json:"task-restore-error"`
+	SuitePrepareError   []string `json:"suite-prepare-error"`
+	SuiteRestoreError   []string `json:"suite-restore-error"`
+	BackendPrepareError []string `json:"backend-prepare-error"`
+	BackendRestoreError []string `json:"backend-restore-error"`
+	ProjectPrepareError []string `json:"project-prepare-error"`
+	ProjectRestoreError []string `json:"project-restore-error"`
+}
+
+// event delivers ev to Options.Events, if set, after filling its type
+// and time. Events are delivered one at a time.
+func (r *Runner) event(typ string, ev Event) {
+	if r.options.Events == nil {
+		return
+	}
+	info := ev.info()
+	info.Type = typ
+	info.Time = time.Now()
+	r.eventsMu.Lock()
+	r.options.Events(ev)
+	r.eventsMu.Unlock()
+}
+
+func (r *Runner) serverEvent(typ string, server Server) {
+	if r.options.Events == nil {
+		return
+	}
+	ev := &ServerEvent{
+		Server:  server.String(),
+		Address: server.Address(),
+	}
+	if system := server.System(); system != nil {
+		ev.Backend = system.Backend
+		ev.System = system.Name
+	}
+	r.event(typ, ev)
+}
+
+func (r *Runner) scriptEvent(typ string, client Executor, job *Job, context interface{}, err error) {
+	if r.options.Events == nil {
+		return
+	}
+	ev := &ScriptEvent{
+		Job:     job.Name,
+		Context: job.StringFor(context),
+		Server:  client.Server().String(),
+	}
+	switch context {
+	case job.Project:
+		ev.Level = "project"
+	case job.Backend:
+		ev.Level = "backend"
+	case job.Suite:
+		ev.Level = "suite"
+	default:
+		ev.Level = "task"
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	r.event(typ, ev)
+}
+
+func (r *Runner) statsEvent() {
+	if r.options.Events == nil {
+		return
+	}
+	s := &r.stats
+	r.event(RunFinished, &StatsEvent{
+		TaskDone:            jobNames(s.TaskDone),
+		TaskFlaky:           jobNames(s.TaskFlaky),
+		TaskError:           jobNames(s.TaskError),
+		TaskAbort:           jobNames(s.TaskAbort),
+		TaskPrepareError:    jobNames(s.TaskPrepareError),
+		TaskRestoreError:    jobNames(s.TaskRestoreError),
+		SuitePrepareError:   jobNames(s.SuitePrepareError),
+		SuiteRestoreError:   jobNames(s.SuiteRestoreError),
+		BackendPrepareError: jobNames(s.BackendPrepareError),
+		BackendRestoreError: jobNames(s.BackendRestoreError),
+		ProjectPrepareError: jobNames(s.ProjectPrepareError),
+		ProjectRestoreError: jobNames(s.ProjectRestoreError),
+	})
+}
+
+func jobNames(jobs []*Job) []string {
+	names := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type EventsSuite struct {
+	dir string
+}
+
+var _ = Suite(&EventsSuite{})
+
+func (s *EventsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *EventsSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *EventsSuite) TestEvents(c *C) {
+	s.write(c, "spread.yaml", `
+project: events-test
+path: /spread-events-test
+backends:
+    local:
+        temp-dir: true
+        systems:
+            - local-host
+prepare: |
+    true
+suites:
+    tests/:
+        summary: Tests
+        restore: |
+            true
+`)
+	s.write(c, "tests/bad/task.yaml", `
+summary: Bad task
+prepare: |
+    true
+execute: |
+    exit 1
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	// Events are delivered one at a time, so no locking is needed.
+	var events []spread.Event
+	options := &spread.Options{Events: func(ev spread.Event) { events = append(events, ev) }}
+	runner, err := spread.Start(project, options)
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), ErrorMatches, "unsuccessful run")
+
+	var types []string
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case *spread.ServerEvent:
+			c.Assert(ev.Backend, Equals, "local")
+			c.Assert(ev.System, Equals, "local-host")
+			c.Assert(ev.Server, Matches, `local:local-host \(.*spread-local-.*\)`)
+			types = append(types, ev.Type)
+		case *spread.ScriptEvent:
+			c.Assert(ev.Job, Equals, "local:local-host:tests/bad")
+			c.Assert(ev.Time.IsZero(), Equals, false)
+			types = append(types, ev.Type+" "+ev.Level+" "+ev.Context+" "+ev.Error)
+		case *spread.StatsEvent:
+			c.Assert(ev.TaskDone, HasLen, 0)
+			c.Assert(ev.TaskError, DeepEquals, []string{"local:local-host:tests/bad"})
+			types = append(types, ev.Type)
+		default:
+			c.Fatalf("Unexpected event: %#v", ev)
+		}
+	}
+	// Only scripts that are defined are run and reported.
+	c.Assert(types, DeepEquals, []string{
+		"server-allocated",
+		"content-sent",
+		"prepare-started project project on local:local-host ",
+		"prepare-finished project project on local:local-host ",
+		"prepare-started task local:local-host:tests/bad ",
+		"prepare-finished task local:local-host:tests/bad ",
+		"execute-started task local:local-host:tests/bad ",
+		"execute-finished task local:local-host:tests/bad + exit 1",
+		"restore-started suite local:local-host:tests/ ",
+		"restore-finished suite local:local-host:tests/ ",
+		"server-discarded",
+		"run-finished",
+	})
+}
@@ -0,0 +1,39 @@
+package spread
+
+import (
+	"time"
+)
+
+// FakeLinodeAPI points the Linode provider at url and makes it poll
+// quickly, returning a function that restores the defaults.
+func FakeLinodeAPI(url string) (restore func()) {
+	oldAPI, oldRetry := linodeAPI, linodeRetry
+	linodeAPI, linodeRetry = url, 10*time.Millisecond
+	return func() {
+		linodeAPI, linodeRetry = oldAPI, oldRetry
+	}
+}
+
+func (t *Timings) SortLongestFirst(jobs []*Job) {
+	t.sortLongestFirst(jobs)
+}
+
+// WriteLastRun records the last run of project as if it had finished
+// with the given jobs in each of the stats the outcomes are taken from.
+func WriteLastRun(project *Project, done, flaky, abort, failed []*Job) error {
+	r := &Runner{project: project}
+	r.stats.TaskDone = done
+	r.stats.TaskFlaky = flaky
+	r.stats.TaskAbort = abort
+	r.stats.TaskError = failed
+	return r.writeLastRun()
+}
+
+type Stats = stats
+
+// WriteJUnit writes the JUnit report of project as if a run had
+// finished with the given statistics and script outputs.
+func WriteJUnit(project *Project, filename string, s Stats, outputs map[string]string) error {
+	r := &Runner{project: project, stats: s, outputs: outputs}
+	return r.writeJUnit(filename)
+}
@@ -0,0 +1,50 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logPath returns the path of the file under Options.Logs that holds
+// the output of scripts run for job in the given context. Task scripts
+// go into one file per job, while project, backend, and suite scripts
+// go into one file per server, since they're run once for many jobs.
+func (r *Runner) logPath(server Server, job *Job, context interface{}) string {
+	dir := filepath.Join(r.options.Logs, job.Backend.Name, job.System.Name)
+	if context == job || context == job.Task {
+		return filepath.Join(dir, taskName(job)+".log")
+	}
+	return filepath.Join(dir, "server-"+safeFileName(server.Address())+".log")
+}
+
+// logOutput appends the output of a script run for job in the given context
+// to its respective log file under Options.Logs, if that option is set.
+func (r *Runner) logOutput(client Executor, job *Job, verb string, context interface{}, output []byte, err error) {
+	if r.options.Logs == "" {
+		return
+	}
+	server := client.Server()
+	filename := r.logPath(server, job, context)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		printf("Cannot create directory for log file: %v", err)
+		return
+	}
+	file, ferr := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if ferr != nil {
+		printf("Cannot open log file: %v", ferr)
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "=== %s %s at %s (%s)\n", strings.Title(verb), job.StringFor(context), server.Address(), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		fmt.Fprintf(file, "%s\n=== Error %s %s\n\n", strings.TrimSpace(err.Error()), verb, job.StringFor(context))
+	} else if len(output) > 0 {
+		fmt.Fprintf(file, "%s\n\n", strings.TrimSpace(string(output)))
+	} else {
+		fmt.Fprintf(file, "\n")
+	}
+}
@@ -0,0 +1,82 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type JobLogsSuite struct {
+	dir string
+}
+
+var _ = Suite(&JobLogsSuite{})
+
+func (s *JobLogsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *JobLogsSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *JobLogsSuite) TestLogs(c *C) {
+	s.write(c, "spread.yaml", `
+project: logs-test
+path: /spread-logs-test
+backends:
+    local:
+        temp-dir: true
+        systems:
+            - local-host
+prepare: |
+    echo project prepare output
+suites:
+    tests/:
+        summary: Tests
+`)
+	s.write(c, "tests/good/task.yaml", `
+summary: Good task
+execute: |
+    echo execute output good
+`)
+	s.write(c, "tests/bad/task.yaml", `
+summary: Bad task
+execute: |
+    echo execute output bad
+    false
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	logs := filepath.Join(s.dir, "logs")
+	runner, err := spread.Start(project, &spread.Options{Logs: logs})
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), ErrorMatches, "unsuccessful run")
+
+	dir := filepath.Join(logs, "local", "local-host")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "tests/good.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `=== Executing local:local-host:tests/good at .*/spread-local-.* \(.*\)\n\+ echo execute output good\nexecute output good\n\n`)
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "tests/bad.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `(?s)=== Executing local:local-host:tests/bad at .*\nexecute output bad\n\+ false\n-----\n=== Error executing local:local-host:tests/bad\n\n`)
+
+	// The address of local servers with temp-dir is a path, which must
+	// not leave the log directory nor create nested directories there.
+	names, err := filepath.Glob(filepath.Join(dir, "server-*.log"))
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 1)
+	c.Assert(filepath.Base(names[0]), Matches, `server-_[a-zA-Z0-9_.-]*_spread-local-[0-9]+\.log`)
+	data, err = ioutil.ReadFile(names[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `=== Preparing project on local:local-host at .*/spread-local-.* \(.*\)\n\+ echo project prepare output\nproject prepare output\n\n`)
+}
@@ -0,0 +1,150 @@
+package spread
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Output  string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitReport builds a JUnit report out of the run statistics. There's
+// one test case per job, grouped into test suites by backend, system and
+// suite, and a separate test case for each failed prepare or restore
+// script at any level.
+func (r *Runner) junitReport() *junitTestSuites {
+	suites := make(map[string]*junitTestSuite)
+	cases := make(map[string]*junitTestCase)
+	addCase := func(job *Job, name string) *junitTestCase {
+		// A script failing on several workers is recorded once per
+		// worker, but it's still a single test case.
+		if tcase, ok := cases[name]; ok {
+			return tcase
+		}
+		sname := job.StringFor(job.Suite)
+		suite, ok := suites[sname]
+		if !ok {
+			suite = &junitTestSuite{Name: sname}
+			suites[sname] = suite
+		}
+		tcase := &junitTestCase{Name: name, Classname: sname}
+		suite.Cases = append(suite.Cases, tcase)
+		cases[name] = tcase
+		return tcase
+	}
+
+	s := &r.stats
+	failed := make(map[*Job]bool)
+	for _, job := range s.TaskError {
+		failed[job] = true
+		tcase := addCase(job, job.Name)
+		tcase.Failure = &junitFailure{
+			Message: "Error executing " + job.Name,
+			Type:    "execute",
+			Output:  r.outputs[executing+" "+job.StringFor(job)],
+		}
+	}
+	for _, jobs := range [][]*Job{s.TaskDone, s.TaskFlaky} {
+		for _, job := range jobs {
+			if !failed[job] {
+				addCase(job, job.Name)
+			}
+		}
+	}
+	for _, job := range s.TaskAbort {
+		tcase := addCase(job, job.Name)
+		tcase.Skipped = &junitSkipped{Message: "Aborted " + job.Name}
+	}
+
+	scripts := []struct {
+		jobs    []*Job
+		verb    string
+		context func(job *Job) interface{}
+	}{
+		{s.TaskPrepareError, preparing, func(job *Job) interface{} { return job }},
+		{s.TaskRestoreError, restoring, func(job *Job) interface{} { return job }},
+		{s.SuitePrepareError, preparing, func(job *Job) interface{} { return job.Suite }},
+		{s.SuiteRestoreError, restoring, func(job *Job) interface{} { return job.Suite }},
+		{s.BackendPrepareError, preparing, func(job *Job) interface{} { return job.Backend }},
+		{s.BackendRestoreError, restoring, func(job *Job) interface{} { return job.Backend }},
+		{s.ProjectPrepareError, preparing, func(job *Job) interface{} { return job.Project }},
+		{s.ProjectRestoreError, restoring, func(job *Job) interface{} { return job.Project }},
+	}
+	for _, script := range scripts {
+		for _, job := range script.jobs {
+			contextStr := job.StringFor(script.context(job))
+			tcase := addCase(job, script.verb+" "+contextStr)
+			tcase.Failure = &junitFailure{
+				Message: fmt.Sprintf("Error %s %s", script.verb, contextStr),
+				Type:    script.verb,
+				Output:  r.outputs[script.verb+" "+contextStr],
+			}
+		}
+	}
+
+	report := &junitTestSuites{Name: r.project.Name}
+	for _, suite := range suites {
+		sort.Slice(suite.Cases, func(i, j int) bool { return suite.Cases[i].Name < suite.Cases[j].Name })
+		for _, tcase := range suite.Cases {
+			suite.Tests++
+			if tcase.Failure != nil {
+				suite.Failures++
+			}
+			if tcase.Skipped != nil {
+				suite.Skipped++
+			}
+		}
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+		report.Suites = append(report.Suites, suite)
+	}
+	sort.Slice(report.Suites, func(i, j int) bool { return report.Suites[i].Name < report.Suites[j].Name })
+	return report
+}
+
+func (r *Runner) writeJUnit(filename string) error {
+	data, err := xml.MarshalIndent(r.junitReport(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal JUnit report: %v", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	data = append(data, '\n')
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("cannot write JUnit report: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package spread_test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type JUnitSuite struct {
+	dir string
+}
+
+var _ = Suite(&JUnitSuite{})
+
+func (s *JUnitSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *JUnitSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+type junitReport struct {
+	Tests    int `xml:"tests,attr"`
+	Failures int `xml:"failures,attr"`
+	Skipped  int `xml:"skipped,attr"`
+	Suites   []struct {
+		Name  string `xml:"name,attr"`
+		Cases []struct {
+			Name    string `xml:"name,attr"`
+			Failure *struct {
+				Message string `xml:"message,attr"`
+				Type    string `xml:"type,attr"`
+				Output  string `xml:",chardata"`
+			} `xml:"failure"`
+			Skipped *struct {
+				Message string `xml:"message,attr"`
+			} `xml:"skipped"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+func (s *JUnitSuite) TestReport(c *C) {
+	s.write(c, "spread.yaml", `
+project: junit-test
+path: /spread-junit-test
+backends:
+    adhoc:
+        allocate: ADDRESS localhost
+        systems:
+            - ubuntu-22.04:
+                workers: 2
+suites:
+    tests/:
+        summary: Regular tests
+    broken/:
+        summary: Broken suite
+`)
+	for _, name := range []string{"tests/good", "tests/bad", "tests/flaky", "broken/one", "broken/two"} {
+		s.write(c, name+"/task.yaml", "summary: Task\n")
+	}
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	byName := make(map[string]*spread.Job)
+	for _, job := range jobs {
+		byName[job.Task.Name] = job
+	}
+
+	// Both workers failed to prepare the broken suite.
+	broken := []*spread.Job{byName["broken/one"], byName["broken/two"]}
+	stats := spread.Stats{
+		TaskDone:          []*spread.Job{byName["tests/good"], byName["tests/flaky"]},
+		TaskFlaky:         []*spread.Job{byName["tests/flaky"]},
+		TaskError:         []*spread.Job{byName["tests/bad"]},
+		TaskAbort:         broken,
+		SuitePrepareError: broken,
+	}
+	outputs := map[string]string{
+		"executing adhoc:ubuntu-22.04:tests/bad": "bad task failed",
+		"preparing adhoc:ubuntu-22.04:broken/":   "suite prepare failed",
+	}
+
+	filename := filepath.Join(s.dir, "junit.xml")
+	c.Assert(spread.WriteJUnit(project, filename, stats, outputs), IsNil)
+
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	var report junitReport
+	c.Assert(xml.Unmarshal(data, &report), IsNil)
+
+	c.Assert(report.Tests, Equals, 6)
+	c.Assert(report.Failures, Equals, 2)
+	c.Assert(report.Skipped, Equals, 2)
+	c.Assert(report.Suites, HasLen, 2)
+
+	suite := report.Suites[0]
+	c.Assert(suite.Name, Equals, "adhoc:ubuntu-22.04:broken/")
+	c.Assert(suite.Cases, HasLen, 3)
+	for i, name := range []string{"adhoc:ubuntu-22.04:broken/one", "adhoc:ubuntu-22.04:broken/two"} {
+		c.Assert(suite.Cases[i].Name, Equals, name)
+		c.Assert(suite.Cases[i].Failure, IsNil)
+		c.Assert(suite.Cases[i].Skipped, NotNil)
+		c.Assert(suite.Cases[i].Skipped.Message, Equals, "Aborted "+name)
+	}
+	c.Assert(suite.Cases[2].Name, Equals, "preparing adhoc:ubuntu-22.04:broken/")
+	c.Assert(suite.Cases[2].Failure, NotNil)
+	c.Assert(suite.Cases[2].Failure.Message, Equals, "Error preparing adhoc:ubuntu-22.04:broken/")
+	c.Assert(suite.Cases[2].Failure.Type, Equals, "preparing")
+	c.Assert(suite.Cases[2].Failure.Output, Equals, "suite prepare failed")
+
+	suite = report.Suites[1]
+	c.Assert(suite.Name, Equals, "adhoc:ubuntu-22.04:tests/")
+	c.Assert(suite.Cases, HasLen, 3)
+	c.Assert(suite.Cases[0].Name, Equals, "adhoc:ubuntu-22.04:tests/bad")
+	c.Assert(suite.Cases[0].Failure, NotNil)
+	c.Assert(suite.Cases[0].Failure.Message, Equals, "Error executing adhoc:ubuntu-22.04:tests/bad")
+	c.Assert(suite.Cases[0].Failure.Type, Equals, "execute")
+	c.Assert(suite.Cases[0].Failure.Output, Equals, "bad task failed")
+
+	// Flaky tasks passed in the end, so they are reported as such.
+	for _, tcase := range suite.Cases[1:] {
+		c.Assert(tcase.Failure, IsNil, Commentf("Test case: %s", tcase.Name))
+		c.Assert(tcase.Skipped, IsNil, Commentf("Test case: %s", tcase.Name))
+	}
+	c.Assert(suite.Cases[1].Name, Equals, "adhoc:ubuntu-22.04:tests/flaky")
+	c.Assert(suite.Cases[2].Name, Equals, "adhoc:ubuntu-22.04:tests/good")
+}
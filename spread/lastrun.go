@@ -0,0 +1,108 @@
+package spread
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+const lastRunFilename = ".spread-last-run.yaml"
+
+// Job outcomes recorded in LastRun.
+const (
+	OutcomeDone         = "done"
+	OutcomeFlaky        = "flaky"
+	OutcomeAbort        = "abort"
+	OutcomeError        = "error"
+	OutcomePrepareError = "prepare-error"
+	OutcomeRestoreError = "restore-error"
+)
+
+// LastRun holds the outcome of every job that was part of the previous
+// run of a project, indexed by job name.
+type LastRun struct {
+	Jobs map[string]string
+}
+
+// ReadLastRun reads the outcome of the jobs in the last run of project.
+func ReadLastRun(project *Project) (*LastRun, error) {
+	data, err := ioutil.ReadFile(filepath.Join(project.Path, lastRunFilename))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot find results of last run in %s", lastRunFilename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read results of last run: %v", err)
+	}
+	var lastRun LastRun
+	if err := yaml.Unmarshal(data, &lastRun); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal results of last run: %v", err)
+	}
+	return &lastRun, nil
+}
+
+// Failed returns the sorted names of the jobs that failed or were aborted.
+func (lr *LastRun) Failed() []string {
+	var names []string
+	for name, outcome := range lr.Jobs {
+		if outcome != OutcomeDone && outcome != OutcomeFlaky {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Filter returns a filter that passes exactly the jobs that failed or
+// were aborted in the last run.
+func (lr *LastRun) Filter() Filter {
+	f := make(nameFilter)
+	for _, name := range lr.Failed() {
+		f[name] = true
+	}
+	return f
+}
+
+type nameFilter map[string]bool
+
+func (f nameFilter) Pass(job *Job) bool {
+	return f[job.Name]
+}
+
+func (r *Runner) writeLastRun() error {
+	lastRun := LastRun{Jobs: make(map[string]string)}
+	s := &r.stats
+	outcomes := []struct {
+		jobs    []*Job
+		outcome string
+	}{
+		{s.TaskDone, OutcomeDone},
+		{s.TaskFlaky, OutcomeFlaky},
+		{s.TaskAbort, OutcomeAbort},
+		{s.TaskError, OutcomeError},
+		{s.TaskPrepareError, OutcomePrepareError},
+		{s.TaskRestoreError, OutcomeRestoreError},
+	}
+	for _, o := range outcomes {
+		for _, job := range o.jobs {
+			lastRun.Jobs[job.Name] = o.outcome
+		}
+	}
+
+	data, err := yaml.Marshal(&lastRun)
+	if err != nil {
+		return fmt.Errorf("internal error: cannot marshal results of last run: %v", err)
+	}
+	filename := filepath.Join(r.project.Path, lastRunFilename)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("cannot write results of last run: %v", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		os.Remove(filename + ".tmp")
+		return fmt.Errorf("cannot write results of last run: %v", err)
+	}
+	return nil
+}
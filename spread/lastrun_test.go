@@ -0,0 +1,86 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LastRunSuite struct {
+	dir string
+}
+
+var _ = Suite(&LastRunSuite{})
+
+func (s *LastRunSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *LastRunSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *LastRunSuite) TestRoundTrip(c *C) {
+	s.write(c, "spread.yaml", `
+project: last-run-test
+path: /last-run-test
+backends:
+    local:
+        systems: [local-host]
+suites:
+    tests/:
+        summary: Tests
+`)
+	for _, name := range []string{"done", "flaky", "abort", "failed"} {
+		s.write(c, "tests/"+name+"/task.yaml", "summary: Task\n")
+	}
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	_, err = spread.ReadLastRun(project)
+	c.Assert(err, ErrorMatches, `cannot find results of last run in \.spread-last-run\.yaml`)
+
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	byName := make(map[string]*spread.Job)
+	for _, job := range jobs {
+		byName[job.Task.Name] = job
+	}
+	c.Assert(byName, HasLen, 4)
+	c.Assert(spread.WriteLastRun(project,
+		[]*spread.Job{byName["tests/done"]},
+		[]*spread.Job{byName["tests/flaky"]},
+		[]*spread.Job{byName["tests/abort"]},
+		[]*spread.Job{byName["tests/failed"]},
+	), IsNil)
+
+	lastRun, err := spread.ReadLastRun(project)
+	c.Assert(err, IsNil)
+	c.Assert(lastRun.Jobs, DeepEquals, map[string]string{
+		"local:local-host:tests/done":   spread.OutcomeDone,
+		"local:local-host:tests/flaky":  spread.OutcomeFlaky,
+		"local:local-host:tests/abort":  spread.OutcomeAbort,
+		"local:local-host:tests/failed": spread.OutcomeError,
+	})
+	c.Assert(lastRun.Failed(), DeepEquals, []string{
+		"local:local-host:tests/abort",
+		"local:local-host:tests/failed",
+	})
+
+	// With -rerun-failed only the jobs that failed or were aborted run.
+	jobs, err = project.Jobs(&spread.Options{Filter: lastRun.Filter()})
+	c.Assert(err, IsNil)
+	names := jobNames(jobs)
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{
+		"local:local-host:tests/abort",
+		"local:local-host:tests/failed",
+	})
+}
@@ -1,14 +1,13 @@
 package spread
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +17,22 @@ import (
 	"gopkg.in/tomb.v2"
 )
 
+func init() {
+	RegisterProvider("linode", Linode)
+	RegisterValidator("linode", validateLinode)
+	RegisterFields("linode", "kernel", "halt-timeout")
+}
+
+func validateLinode(p *Project, b *Backend) error {
+	if strings.TrimSpace(b.Key) == "" {
+		return fmt.Errorf("%s requires a key field", b)
+	}
+	if b.HaltTimeout.Duration < 0 {
+		return fmt.Errorf("%s has negative halt-timeout", b)
+	}
+	return nil
+}
+
 func Linode(p *Project, b *Backend, o *Options) Provider {
 	return &linodeProvider{
 		project: p,
@@ -46,6 +61,12 @@ type linodeProvider struct {
 
 var client = &http.Client{}
 
+// linodeAPI is the base URL of the Linode API.
+var linodeAPI = "https://api.linode.com/v4"
+
+// linodeRetry is how often the state of pending operations is polled.
+var linodeRetry = 5 * time.Second
+
 type linodeServer struct {
 	p *linodeProvider
 	d linodeServerData
@@ -53,13 +74,16 @@ type linodeServer struct {
 	system  *System
 	address string
 
+	// keyed is whether the public key was authorized on the root disk.
+	keyed bool
+
 	watchTomb tomb.Tomb
 }
 
 type linodeServerData struct {
-	ID     int    `json:"LINODEID"`
-	Label  string `json:"LABEL"`
-	Status int    `json:"STATUS" yaml:"-"`
+	ID     int    `json:"id"`
+	Label  string `json:"label"`
+	Status string `json:"status" yaml:"-"`
 	Config int    `json:"-"`
 	Root   int    `json:"-"`
 	Swap   int    `json:"-"`
@@ -85,6 +109,10 @@ func (s *linodeServer) ReuseData() interface{} {
 	return &s.d
 }
 
+func (s *linodeServer) KeyAuthorized() bool {
+	return s.keyed
+}
+
 func (s *linodeServer) watch() {
 	s.watchTomb.Go(s.watchLoop)
 }
@@ -98,13 +126,13 @@ func (s *linodeServer) watchLoop() error {
 			return nil
 		case <-retry.C:
 			status, err := s.p.status(s)
-			if err == nil && status == linodePoweredOff {
-				found, _, _ := s.p.hasActiveJob(s, "linode.boot", noLog)
+			if err == nil && status == linodeOffline {
+				found, _, _ := s.p.hasActiveEvent(s, "linode_boot", noLog)
 				if found {
 					continue
 				}
 				printf("Found %s powered off. Starting it again.", s)
-				_, err := s.p.boot(s, s.d.Config)
+				err := s.p.boot(s, s.d.Config)
 				if err != nil {
 					printf("Cannot boot %s: %s", s, err)
 				}
@@ -115,24 +143,30 @@ func (s *linodeServer) watchLoop() error {
 }
 
 const (
-	linodeBeingCreated = -1
-	linodeBrandNew     = 0
-	linodeRunning      = 1
-	linodePoweredOff   = 2
+	linodeOffline = "offline"
+	linodeRunning = "running"
 )
 
 type linodeResult struct {
-	Errors []linodeError `json:"ERRORARRAY"`
+	Errors []linodeError `json:"errors"`
 }
 
 type linodeError struct {
-	Code    int    `json:"ERRORCODE"`
-	Message string `json:"ERRORMESSAGE"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
 }
 
 func (r *linodeResult) err() error {
 	for _, e := range r.Errors {
-		return fmt.Errorf("%s", strings.ToLower(string(e.Message[0]))+e.Message[1:])
+		msg := e.Reason
+		if msg == "" {
+			msg = "unknown error"
+		}
+		msg = strings.ToLower(msg[:1]) + msg[1:]
+		if e.Field != "" {
+			return fmt.Errorf("%s: %s", e.Field, msg)
+		}
+		return fmt.Errorf("%s", msg)
 	}
 	return nil
 }
@@ -190,10 +224,10 @@ func (p *linodeProvider) Allocate(system *System) (Server, error) {
 	lastjobs := make([]time.Time, len(servers))
 	for _, i := range perm {
 		s := servers[i]
-		if (s.d.Status != linodeBrandNew && s.d.Status != linodePoweredOff) || !p.reserve(s) {
+		if s.d.Status != linodeOffline || !p.reserve(s) {
 			continue
 		}
-		found, lastjob, err := p.hasActiveJob(s, "", 0)
+		found, lastjob, err := p.hasActiveEvent(s, "", 0)
 		lastjobs[i] = lastjob
 		if found || err != nil {
 			if err != nil {
@@ -219,7 +253,7 @@ func (p *linodeProvider) Allocate(system *System) (Server, error) {
 	for i, s := range servers {
 		lastjob := lastjobs[i]
 		if lastjob.IsZero() {
-			_, lastjob, _ = p.hasActiveJob(s, "", 0)
+			_, lastjob, _ = p.hasActiveEvent(s, "", 0)
 			lastjobs[i] = lastjob
 		}
 		if lastjob.After(newest) {
@@ -240,7 +274,7 @@ func (p *linodeProvider) Allocate(system *System) (Server, error) {
 		}
 
 		// Ensure no recent activity again.
-		found, _, err := p.hasActiveJob(s, "", 0)
+		found, _, err := p.hasActiveEvent(s, "", 0)
 		if found || err != nil {
 			if err != nil {
 				printf("Cannot check %s for active jobs: %v", s, err)
@@ -249,7 +283,10 @@ func (p *linodeProvider) Allocate(system *System) (Server, error) {
 		}
 
 		printf("Server %s exceeds halt-timeout. Shutting it down...", s)
-		_, err = p.shutdown(s)
+		err = p.shutdown(s)
+		if err == nil {
+			err = p.waitStatus(s, "shut down", linodeOffline)
+		}
 		if err != nil {
 			printf("Cannot shutdown %s after halt-timeout: %v", s, err)
 			continue
@@ -270,96 +307,175 @@ func (p *linodeProvider) Allocate(system *System) (Server, error) {
 func (s *linodeServer) Discard() error {
 	s.watchTomb.Kill(nil)
 	s.watchTomb.Wait()
-	_, err1 := s.p.shutdown(s)
+	err1 := s.p.shutdown(s)
+	if err1 == nil {
+		err1 = s.p.waitStatus(s, "shut down", linodeOffline)
+	}
 	err2 := s.p.removeConfig(s, s.d.Config)
 	err3 := s.p.removeDisks(s, s.d.Root, s.d.Swap)
 	s.p.unreserve(s)
 	return firstErr(err1, err2, err3)
 }
 
-type linodeListResult struct {
-	linodeResult
-	Data []linodeServerData `json:"DATA"`
+// linodePage is a page of results from one of the listing endpoints.
+type linodePage struct {
+	Data  json.RawMessage `json:"data"`
+	Page  int             `json:"page"`
+	Pages int             `json:"pages"`
+}
+
+// linodeFilter is sent as the X-Filter header of listing requests.
+type linodeFilter map[string]interface{}
+
+// listAll calls add with the data of every page of results from path,
+// which must be one of the listing endpoints.
+func (p *linodeProvider) listAll(path string, add func(data []byte) error) error {
+	for page := 1; ; page++ {
+		var result linodePage
+		err := p.dofl("GET", fmt.Sprintf("%s?page=%d&page_size=500", path, page), nil, &result, 0)
+		if err == nil {
+			err = add(result.Data)
+		}
+		if err != nil {
+			return err
+		}
+		if result.Page >= result.Pages {
+			return nil
+		}
+	}
 }
 
 func (p *linodeProvider) list() ([]*linodeServer, error) {
 	debug("Listing available Linode servers...")
-	params := linodeParams{
-		"api_action": "linode.list",
-	}
-	var result linodeListResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
+	var servers []*linodeServer
+	err := p.listAll("/linode/instances", func(data []byte) error {
+		var page []linodeServerData
+		if err := json.Unmarshal(data, &page); err != nil {
+			return fmt.Errorf("cannot decode Linode server list: %v", err)
+		}
+		for _, d := range page {
+			servers = append(servers, &linodeServer{p: p, d: d})
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
-	}
-	servers := make([]*linodeServer, len(result.Data))
-	for i, d := range result.Data {
-		servers[i] = &linodeServer{p: p, d: d}
+		return nil, fmt.Errorf("cannot list Linode servers: %v", err)
 	}
 	return servers, nil
 }
 
-func (p *linodeProvider) status(s *linodeServer) (int, error) {
+func (p *linodeProvider) status(s *linodeServer) (string, error) {
 	debugf("Checking power status of %s...", s)
-	params := linodeParams{
-		"api_action": "linode.list",
-		"LinodeID":   s.d.ID,
-	}
-	var result linodeListResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
+	var result linodeServerData
+	err := p.do("GET", fmt.Sprintf("/linode/instances/%d", s.d.ID), nil, &result)
 	if err != nil {
-		return 0, err
+		return "", fmt.Errorf("cannot get status of %s: %v", s, err)
 	}
-	if len(result.Data) == 0 {
-		return 0, fmt.Errorf("cannot find %s data", s)
+	return result.Status, nil
+}
+
+func (p *linodeProvider) waitStatus(s *linodeServer, verb, status string) error {
+	logf("Waiting for %s to %s...", s, verb)
+
+	timeout := time.After(3 * time.Minute)
+	retry := time.NewTicker(linodeRetry)
+	defer retry.Stop()
+
+	var infoErr error
+	for {
+		select {
+		case <-timeout:
+			if infoErr != nil {
+				return infoErr
+			}
+			return fmt.Errorf("timeout waiting for %s to %s", s, verb)
+
+		case <-retry.C:
+			current, err := p.status(s)
+			if err != nil {
+				infoErr = fmt.Errorf("cannot %s %s: %s", verb, s, err)
+				break
+			}
+			if current == status {
+				return nil
+			}
+		}
 	}
-	return result.Data[0].Status, nil
 }
 
 func (p *linodeProvider) setup(s *linodeServer, system *System, lastjob time.Time) error {
 	s.p = p
 	s.system = system
 
-	rootJob, swapJob, err := p.createDisk(s, system)
+	template, kernel, err := p.template(system)
 	if err != nil {
 		return err
 	}
-	s.d.Root = rootJob.DiskID
-	s.d.Swap = swapJob.DiskID
 
-	if _, err := p.waitJob(s, "allocate disk", rootJob.JobID); err != nil {
-		p.removeDisks(s, s.d.Root, s.d.Swap)
+	// Smallest disk is 24576MB. (6000+128)*4 < 24576,
+	// so may halt three times without breaking.
+	logf("Creating disk on %s with %s...", s, system.Image)
+	rootPost := &linodeDiskPost{
+		Label:    SystemLabel(system, "root"),
+		Size:     6000,
+		Image:    template.ID,
+		RootPass: p.options.Password,
+	}
+	if p.options.PublicKey != "" {
+		rootPost.AuthorizedKeys = []string{p.options.PublicKey}
+		// Only public images are known to honor authorized_keys.
+		s.keyed = template.IsPublic
+	}
+	root, err := p.createDisk(s, rootPost)
+	if err != nil {
+		return fmt.Errorf("cannot create Linode disk with %s: %v", system.Name, err)
+	}
+	s.d.Root = root.ID
+
+	if err := p.waitDisk(s, "allocate disk", root.ID); err != nil {
+		p.removeDisks(s, s.d.Root)
 		return err
 	}
 
 	if status, err := p.status(s); err != nil {
-		p.removeDisks(s, s.d.Root, s.d.Swap)
+		p.removeDisks(s, s.d.Root)
 		return err
-	} else if status != linodeBrandNew && status != linodePoweredOff {
-		p.removeDisks(s, s.d.Root, s.d.Swap)
+	} else if status != linodeOffline {
+		p.removeDisks(s, s.d.Root)
 		return fmt.Errorf("server %s concurrently allocated, giving up on it", s)
 	}
 	if conflict, err := p.hasRecentDisk(s, s.d.Root); err != nil {
-		p.removeDisks(s, s.d.Root, s.d.Swap)
+		p.removeDisks(s, s.d.Root)
 		return err
 	} else if conflict {
-		p.removeDisks(s, s.d.Root, s.d.Swap)
+		p.removeDisks(s, s.d.Root)
 		return fmt.Errorf("server %s concurrently allocated, giving up on it", s)
 	}
 
+	swap, err := p.createDisk(s, &linodeDiskPost{
+		Label:      SystemLabel(system, "swap"),
+		Size:       128,
+		Filesystem: "swap",
+	})
+	if err == nil {
+		s.d.Swap = swap.ID
+		err = p.waitDisk(s, "allocate swap", swap.ID)
+	} else {
+		err = fmt.Errorf("cannot create Linode swap disk: %v", err)
+	}
+	if err != nil {
+		p.removeDisks(s, s.d.Root, s.d.Swap)
+		return err
+	}
+
 	ip, err := p.ip(s)
 	if err != nil {
+		p.removeDisks(s, s.d.Root, s.d.Swap)
 		return err
 	}
-	s.address = ip.IPAddress
+	s.address = ip
 
-	configID, err := p.createConfig(s, system, s.d.Root, s.d.Swap)
+	configID, err := p.createConfig(s, system, kernel, s.d.Root, s.d.Swap)
 	if err != nil {
 		p.removeDisks(s, s.d.Root, s.d.Swap)
 		return err
@@ -376,9 +492,9 @@ func (p *linodeProvider) setup(s *linodeServer, system *System, lastjob time.Tim
 		return fmt.Errorf("server %s has external boot activity, giving up on it", s)
 	}
 
-	bootJob, err := p.boot(s, configID)
+	err = p.boot(s, configID)
 	if err == nil {
-		_, err = p.waitJob(s, "boot", bootJob.JobID)
+		err = p.waitStatus(s, "boot", linodeRunning)
 	}
 	if err != nil {
 		p.removeConfig(s, s.d.Config)
@@ -389,150 +505,123 @@ func (p *linodeProvider) setup(s *linodeServer, system *System, lastjob time.Tim
 	return nil
 }
 
-type linodeSimpleJob struct {
-	JobID int `json:"JOBID"`
+type linodeBootPost struct {
+	ConfigID int `json:"config_id"`
 }
 
-type linodeSimpleJobResult struct {
-	linodeResult
-	Data *linodeSimpleJob `json:"DATA"`
+func (p *linodeProvider) boot(s *linodeServer, configID int) error {
+	return p.action(s, "boot", &linodeBootPost{configID})
 }
 
-func (p *linodeProvider) boot(s *linodeServer, configID int) (*linodeSimpleJob, error) {
-	return p.simpleJob(s, "boot", linodeParams{
-		"api_action": "linode.boot",
-		"LinodeID":   s.d.ID,
-		"ConfigID":   configID,
-	})
+func (p *linodeProvider) shutdown(s *linodeServer) error {
+	return p.action(s, "shutdown", nil)
 }
 
-func (p *linodeProvider) reboot(s *linodeServer, configID int) (*linodeSimpleJob, error) {
-	return p.simpleJob(s, "reboot", linodeParams{
-		"api_action": "linode.reboot",
-		"LinodeID":   s.d.ID,
-		"ConfigID":   configID,
-	})
-}
-
-func (p *linodeProvider) shutdown(s *linodeServer) (*linodeSimpleJob, error) {
-	return p.simpleJob(s, "shutdown", linodeParams{
-		"api_action": "linode.shutdown",
-		"LinodeID":   s.d.ID,
-	})
-}
-
-func (p *linodeProvider) simpleJob(s *linodeServer, verb string, params linodeParams) (*linodeSimpleJob, error) {
-	var result linodeSimpleJobResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
+func (p *linodeProvider) action(s *linodeServer, verb string, params interface{}) error {
+	err := p.do("POST", fmt.Sprintf("/linode/instances/%d/%s", s.d.ID, verb), params, nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot %s %s: %v", verb, s, err)
+		return fmt.Errorf("cannot %s %s: %v", verb, s, err)
 	}
-	return result.Data, nil
+	return nil
 }
 
-type linodeDiskJob struct {
-	DiskID int `json:"DISKID"`
-	JobID  int `json:"JOBID"`
+type linodeDiskPost struct {
+	Label          string   `json:"label"`
+	Size           int      `json:"size"`
+	Image          string   `json:"image,omitempty"`
+	RootPass       string   `json:"root_pass,omitempty"`
+	AuthorizedKeys []string `json:"authorized_keys,omitempty"`
+	Filesystem     string   `json:"filesystem,omitempty"`
 }
 
-type linodeDiskJobResult struct {
-	linodeResult
-	Data *linodeDiskJob `json:"DATA"`
+type linodeDisk struct {
+	ID         int    `json:"id"`
+	Label      string `json:"label"`
+	Status     string `json:"status"`
+	Size       int    `json:"size"`
+	Filesystem string `json:"filesystem"`
+	CreatedDT  string `json:"created"`
+	UpdatedDT  string `json:"updated"`
+}
+
+func (d *linodeDisk) Created() time.Time {
+	return parseLinodeDT(d.CreatedDT)
 }
 
-func (p *linodeProvider) createDisk(s *linodeServer, system *System) (root, swap *linodeDiskJob, err error) {
-	template, _, err := p.template(system)
+func (p *linodeProvider) createDisk(s *linodeServer, params *linodeDiskPost) (*linodeDisk, error) {
+	var disk linodeDisk
+	err := p.do("POST", fmt.Sprintf("/linode/instances/%d/disks", s.d.ID), params, &disk)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return &disk, nil
+}
 
-	// Smallest disk is 24576MB. (6000+128)*4 < 24576,
-	// so may halt three times without breaking.
-	createRoot := linodeParams{
-		"LinodeID": s.d.ID,
-		"Label":    SystemLabel(system, "root"),
-		"Size":     6000,
-		"rootPass": p.options.Password,
-	}
-	createSwap := linodeParams{
-		"api_action": "linode.disk.create",
-		"LinodeID":   s.d.ID,
-		"Label":      SystemLabel(system, "swap"),
-		"Size":       128,
-		"Type":       "swap",
-	}
+func (p *linodeProvider) waitDisk(s *linodeServer, verb string, diskID int) error {
+	logf("Waiting for %s to %s...", s, verb)
 
-	logf("Creating disk on %s with %s...", s, system.Image)
-	params := linodeParams{
-		"api_action":       "batch",
-		"api_requestArray": []linodeParams{createRoot, createSwap},
-	}
+	// Used to be 1 min up to Aug 2016, but disk allocation timeouts were frequently observed.
+	timeout := time.After(3 * time.Minute)
+	retry := time.NewTicker(linodeRetry)
+	defer retry.Stop()
 
-	if template.DistroID > 0 {
-		createRoot["api_action"] = "linode.disk.createFromDistribution"
-		createRoot["DistributionID"] = template.DistroID
-	} else {
-		createRoot["api_action"] = "linode.disk.createFromImage"
-		createRoot["ImageID"] = template.ImageID
-	}
+	var infoErr error
+	for {
+		select {
+		case <-timeout:
+			if infoErr != nil {
+				return infoErr
+			}
+			return fmt.Errorf("timeout waiting for %s to %s", s, verb)
 
-	var results []linodeDiskJobResult
-	err = p.do(params, &results)
-	for i, result := range results {
-		if err == nil {
-			err = result.err()
-		}
-		if i == 0 {
-			root = result.Data
-		} else {
-			swap = result.Data
+		case <-retry.C:
+			var disk linodeDisk
+			err := p.do("GET", fmt.Sprintf("/linode/instances/%d/disks/%d", s.d.ID, diskID), nil, &disk)
+			if isLinodeNotFound(err) {
+				// Disks that fail to be created are removed.
+				return fmt.Errorf("cannot %s %s: disk %d is gone", verb, s, diskID)
+			}
+			if err != nil {
+				infoErr = fmt.Errorf("cannot %s %s: %s", verb, s, err)
+				break
+			}
+			if disk.Status == "ready" {
+				return nil
+			}
 		}
 	}
-	if len(results) == 0 || err == nil && (root == nil || swap == nil) {
-		err = fmt.Errorf("empty batch result")
-	}
-	if err == nil {
-		return root, swap, nil
-	}
-	if root != nil {
-		p.removeDisks(s, root.DiskID)
-	}
-	if swap != nil {
-		p.removeDisks(s, swap.DiskID)
-	}
-	return nil, nil, fmt.Errorf("cannot create Linode disk with %s: %v", system.Name, err)
 }
 
 func (p *linodeProvider) removeDisks(s *linodeServer, diskIDs ...int) error {
 	logf("Removing disks from %s...", s)
-	var batch []linodeParams
 	for _, diskID := range diskIDs {
-		batch = append(batch, linodeParams{
-			"api_action": "linode.disk.delete",
-			"LinodeID":   s.d.ID,
-			"DiskID":     diskID,
-		})
-	}
-	params := linodeParams{
-		"api_action":       "batch",
-		"api_requestArray": batch,
-	}
-	var results []linodeResult
-	err := p.do(params, &results)
-	if err != nil {
-		return fmt.Errorf("cannot remove disk on %s: %v", s, err)
-	}
-	for _, result := range results {
-		if err := result.err(); err != nil {
+		if diskID == 0 {
+			continue
+		}
+		err := p.do("DELETE", fmt.Sprintf("/linode/instances/%d/disks/%d", s.d.ID, diskID), nil, nil)
+		if err != nil && !isLinodeNotFound(err) {
 			return fmt.Errorf("cannot remove disk on %s: %v", s, err)
 		}
 	}
 	return nil
 }
 
+func (p *linodeProvider) disks(s *linodeServer) ([]*linodeDisk, error) {
+	var disks []*linodeDisk
+	err := p.listAll(fmt.Sprintf("/linode/instances/%d/disks", s.d.ID), func(data []byte) error {
+		var page []*linodeDisk
+		if err := json.Unmarshal(data, &page); err != nil {
+			return fmt.Errorf("cannot decode Linode disk list: %v", err)
+		}
+		disks = append(disks, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
 func username() string {
 	for _, name := range []string{"USER", "LOGNAME"} {
 		if user := os.Getenv(name); user != "" {
@@ -545,20 +634,29 @@ func username() string {
 	return ""
 }
 
-type linodeConfigResult struct {
-	linodeResult
-	Data struct {
-		ConfigID int `json:"CONFIGID"`
-	} `json:"DATA"`
+type linodeConfigPost struct {
+	Label      string                         `json:"label"`
+	Comments   string                         `json:"comments"`
+	Kernel     string                         `json:"kernel"`
+	Devices    map[string]*linodeConfigDevice `json:"devices"`
+	RootDevice string                         `json:"root_device"`
+	Helpers    linodeConfigHelpers            `json:"helpers"`
 }
 
-func (p *linodeProvider) createConfig(s *linodeServer, system *System, rootID, swapID int) (configID int, err error) {
-	logf("Creating configuration on %s with %s...", s, system.Name)
+type linodeConfigDevice struct {
+	DiskID int `json:"disk_id"`
+}
 
-	_, kernel, err := p.template(system)
-	if err != nil {
-		return 0, err
-	}
+type linodeConfigHelpers struct {
+	UpdateDBDisabled  bool `json:"updatedb_disabled"`
+	Distro            bool `json:"distro"`
+	ModulesDep        bool `json:"modules_dep"`
+	Network           bool `json:"network"`
+	DevTmpFsAutomount bool `json:"devtmpfs_automount"`
+}
+
+func (p *linodeProvider) createConfig(s *linodeServer, system *System, kernel *linodeKernel, rootID, swapID int) (configID int, err error) {
+	logf("Creating configuration on %s with %s...", s, system.Name)
 
 	reuse := ""
 	if p.options.Reuse {
@@ -566,160 +664,83 @@ func (p *linodeProvider) createConfig(s *linodeServer, system *System, rootID, s
 	}
 	comments := fmt.Sprintf("USER=%q spread\n-pass=%q %s", username(), p.options.Password, reuse)
 
-	params := linodeParams{
-		"api_action":             "linode.config.create",
-		"LinodeID":               s.d.ID,
-		"KernelID":               kernel.ID,
-		"Label":                  SystemLabel(system, ""),
-		"Comments":               comments,
-		"DiskList":               fmt.Sprintf("%d,%d", rootID, swapID),
-		"RootDeviceNum":          1,
-		"RootDeviceR0":           true,
-		"helper_disableUpdateDB": true,
-		"helper_distro":          true,
-		"helper_depmod":          true,
-		"helper_network":         false,
-		"devtmpfs_automount":     true,
-	}
-
-	var result linodeConfigResult
-	err = p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
+	params := &linodeConfigPost{
+		Label:    SystemLabel(system, ""),
+		Comments: comments,
+		Kernel:   kernel.ID,
+		Devices: map[string]*linodeConfigDevice{
+			"sda": {rootID},
+			"sdb": {swapID},
+		},
+		RootDevice: "/dev/sda",
+		Helpers: linodeConfigHelpers{
+			UpdateDBDisabled:  true,
+			Distro:            true,
+			ModulesDep:        true,
+			Network:           false,
+			DevTmpFsAutomount: true,
+		},
+	}
+
+	var result struct {
+		ID int `json:"id"`
+	}
+	err = p.do("POST", fmt.Sprintf("/linode/instances/%d/configs", s.d.ID), params, &result)
 	if err != nil {
 		return 0, fmt.Errorf("cannot create config on %s with %s: %v", s, system.Name, err)
 	}
-	return result.Data.ConfigID, nil
+	return result.ID, nil
 }
 
 func (p *linodeProvider) removeConfig(s *linodeServer, configID int) error {
 	logf("Removing configuration from %s...", s)
 
-	params := linodeParams{
-		"api_action": "linode.config.delete",
-		"LinodeID":   s.d.ID,
-		"ConfigID":   configID,
-	}
-	var result linodeResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
-	if err != nil {
+	err := p.do("DELETE", fmt.Sprintf("/linode/instances/%d/configs/%d", s.d.ID, configID), nil, nil)
+	if err != nil && !isLinodeNotFound(err) {
 		return fmt.Errorf("cannot remove config from %s: %v", s, err)
 	}
 	return nil
 }
 
-type linodeJob struct {
-	JobID        int    `json:"JOBID"`
-	LinodeID     int    `json:"LINODEID"`
-	Action       string `json:"ACTION"`
-	Label        string `json:"LABEL"`
-	HostMessage  string `json:"HOST_MESSAGE"`
-	HostStartDT  string `json:"HOST_START_DT"`
-	HostFinishDT string `json:"HOST_FINISH_DT"`
-	EnteredDT    string `json:"ENTERED_DT"`
-
-	// Linode bug: sometimes "", generally 1/0, see https://goo.gl/fxVyaz.
-	HostSuccess interface{} `json:"HOST_SUCCESS"`
+// linodeEvent is an entry in the account event log, which takes the
+// place of the per-server job queue of earlier API versions.
+type linodeEvent struct {
+	ID        int    `json:"id"`
+	Action    string `json:"action"`
+	Status    string `json:"status"`
+	CreatedDT string `json:"created"`
+	Message   string `json:"message"`
 }
 
-func (job *linodeJob) Entered() time.Time {
-	return parseLinodeDT(job.EnteredDT)
-}
-
-func (job *linodeJob) err() error {
-	if job.HostSuccess == 1.0 || job.HostFinishDT == "" {
-		return nil
-	}
-	if msg := job.HostMessage; msg != "" {
-		return fmt.Errorf("%s", strings.ToLower(string(msg[0]))+msg[1:])
-	}
-	return fmt.Errorf("job %d failed silently", job.JobID)
+func (e *linodeEvent) Created() time.Time {
+	return parseLinodeDT(e.CreatedDT)
 }
 
-type linodeJobResult struct {
-	linodeResult
-	Data []*linodeJob `json:"DATA"`
+// Active returns whether the event refers to an operation in progress.
+func (e *linodeEvent) Active() bool {
+	return e.Status == "scheduled" || e.Status == "started"
 }
 
-func (p *linodeProvider) jobs(s *linodeServer, flags doFlags) ([]*linodeJob, error) {
-	params := linodeParams{
-		"api_action": "linode.job.list",
-		"LinodeID":   s.d.ID,
+// events returns the events for the server, most recent first.
+func (p *linodeProvider) events(s *linodeServer, flags doFlags) ([]*linodeEvent, error) {
+	filter := linodeFilter{
+		"entity.type": "linode",
+		"entity.id":   s.d.ID,
+		"+order_by":   "created",
+		"+order":      "desc",
 	}
-	var result linodeJobResult
-	err := p.dofl(params, &result, flags)
-	if err == nil {
-		err = result.err()
+	var result struct {
+		Data []*linodeEvent `json:"data"`
 	}
+	// Only the most recent page matters.
+	err := p.dofl("GET", "/account/events?page_size=100", filter, &result, flags)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get job details for %s: %v", s, err)
+		return nil, fmt.Errorf("cannot get event details for %s: %v", s, err)
 	}
 	return result.Data, nil
 }
 
-func (p *linodeProvider) job(s *linodeServer, jobID int) (*linodeJob, error) {
-	params := linodeParams{
-		"api_action": "linode.job.list",
-		"LinodeID":   s.d.ID,
-		"JobID":      jobID,
-	}
-	var result linodeJobResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
-	if err == nil && len(result.Data) == 0 {
-		err = fmt.Errorf("empty result")
-	}
-	if err != nil {
-		return nil, fmt.Errorf("cannot get job details for %s: %v", s, err)
-	}
-	return result.Data[0], nil
-}
-
-func (p *linodeProvider) waitJob(s *linodeServer, verb string, jobID int) (*linodeJob, error) {
-	logf("Waiting for %s to %s...", s, verb)
-
-	// Used to be 1 min up to Aug 2016, but disk allocation timeouts were frequently observed.
-	timeout := time.After(3 * time.Minute)
-	retry := time.NewTicker(5 * time.Second)
-	defer retry.Stop()
-
-	var infoErr error
-	for {
-		select {
-		case <-timeout:
-			// Don't shutdown. The machine may be running something else.
-			if infoErr != nil {
-				return nil, infoErr
-			}
-			p.removeConfig(s, s.d.Config)
-			p.removeDisks(s, s.d.Root, s.d.Swap)
-			return nil, fmt.Errorf("timeout waiting for %s to %s", s, verb)
-
-		case <-retry.C:
-			job, err := p.job(s, jobID)
-			if err != nil {
-				infoErr = fmt.Errorf("cannot %s %s: %s", verb, s, err)
-				break
-			}
-			if job.HostFinishDT != "" {
-				err := job.err()
-				if err != nil {
-					err = fmt.Errorf("cannot %s %s: %s", verb, s, err)
-				}
-				return job, err
-			}
-		}
-	}
-	panic("unreachable")
-}
-
-func (p *linodeProvider) hasActiveJob(s *linodeServer, action string, flags doFlags) (found bool, lastjob time.Time, err error) {
+func (p *linodeProvider) hasActiveEvent(s *linodeServer, action string, flags doFlags) (found bool, lastjob time.Time, err error) {
 	kind := ""
 	if action != "" {
 		kind += " " + action
@@ -727,15 +748,15 @@ func (p *linodeProvider) hasActiveJob(s *linodeServer, action string, flags doFl
 	if flags&noLog == 0 {
 		debugf("Checking %s for active%s jobs...", s, kind)
 	}
-	jobs, err := p.jobs(s, flags)
+	events, err := p.events(s, flags)
 	if err != nil {
 		return false, time.Time{}, err
 	}
-	if len(jobs) > 0 {
-		lastjob = jobs[0].Entered()
+	if len(events) > 0 {
+		lastjob = events[0].Created()
 	}
-	for _, job := range jobs {
-		if job.HostFinishDT == "" && (action == "" || job.Action == action) {
+	for _, event := range events {
+		if event.Active() && (action == "" || event.Action == action) {
 			return true, lastjob, nil
 		}
 	}
@@ -744,61 +765,24 @@ func (p *linodeProvider) hasActiveJob(s *linodeServer, action string, flags doFl
 
 func (p *linodeProvider) hasRecentBoot(s *linodeServer, since time.Time) (found bool, err error) {
 	debugf("Checking %s for recent boots...", s)
-	jobs, err := p.jobs(s, 0)
+	events, err := p.events(s, 0)
 	if err != nil {
 		return false, fmt.Errorf("cannot check %s for recent boots: %v", s, err)
 	}
-	for _, job := range jobs {
-		if job.Action == "linode.shutdown" && job.HostFinishDT != "" {
+	for _, event := range events {
+		if event.Action == "linode_shutdown" && !event.Active() {
 			return false, nil
 		}
-		if !job.Entered().After(since) {
+		if !event.Created().After(since) {
 			return false, nil
 		}
-		if job.Action == "linode.boot" {
+		if event.Action == "linode_boot" {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
-type linodeDisk struct {
-	UpdateDT   string `json:"UPDATE_DT"`
-	Type       string `json:"TYPE"`
-	Status     int    `json:"STATUS"`
-	DiskID     int    `json:"DISKID"`
-	CreateDT   string `json:"CREATE_DT"`
-	IsReadOnly int    `josn:"ISREADONLY"`
-	LinodeID   int    `json:"LINODEID"`
-	Label      string `json:"LABEL"`
-	Size       int    `json:"SIZE"`
-}
-
-func (d *linodeDisk) Created() time.Time {
-	return parseLinodeDT(d.CreateDT)
-}
-
-type linodeDiskResult struct {
-	linodeResult
-	Data []*linodeDisk `json:"DATA"`
-}
-
-func (p *linodeProvider) disks(s *linodeServer) ([]*linodeDisk, error) {
-	params := linodeParams{
-		"api_action": "linode.disk.list",
-		"LinodeID":   s.d.ID,
-	}
-	var result linodeDiskResult
-	err := p.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
-	if err != nil {
-		return nil, err
-	}
-	return result.Data, nil
-}
-
 // hasRecentDisk returns an error if there's a disk that is ready and
 // was created up to a minute before the provided disk ID. If two clients
 // use this logic, the most recent one will concede the machine usage to
@@ -814,7 +798,7 @@ func (p *linodeProvider) hasRecentDisk(s *linodeServer, diskID int) (bool, error
 
 	var limit time.Time
 	for _, d := range disks {
-		if d.DiskID == diskID {
+		if d.ID == diskID {
 			limit = d.Created()
 		}
 	}
@@ -830,84 +814,45 @@ func (p *linodeProvider) hasRecentDisk(s *linodeServer, diskID int) (bool, error
 	return false, nil
 }
 
-type linodeIPResult struct {
-	linodeResult
-	Data []*linodeIP `json:"DATA"`
+type linodeIPs struct {
+	IPv4 struct {
+		Public []struct {
+			Address string `json:"address"`
+		} `json:"public"`
+	} `json:"ipv4"`
 }
 
-type linodeIP struct {
-	ID        int    `json:"IPADDRESSID"`
-	LinodeID  int    `json:"LINODEID"`
-	IsPublic  int    `json:"ISPUBLIC"`
-	IPAddress string `json:"IPADDRESS"`
-	RDNSName  string `json:"RDNS_NAME"`
-}
-
-func (p *linodeProvider) ip(s *linodeServer) (*linodeIP, error) {
+func (p *linodeProvider) ip(s *linodeServer) (string, error) {
 	logf("Obtaining address of %s...", s)
 
-	params := linodeParams{
-		"api_action": "linode.ip.list",
-		"LinodeID":   s.d.ID,
-	}
-	var result linodeIPResult
-	err := p.do(params, &result)
+	var result linodeIPs
+	err := p.do("GET", fmt.Sprintf("/linode/instances/%d/ips", s.d.ID), nil, &result)
 	if err != nil {
-		return nil, err
-	}
-	if err := result.err(); err != nil {
-		return nil, fmt.Errorf("cannot list IPs for %s: %v", s, err)
+		return "", fmt.Errorf("cannot list IPs for %s: %v", s, err)
 	}
-	for _, ip := range result.Data {
-		if ip.IsPublic == 1 {
-			logf("Got address of %s: %s", s, ip.IPAddress)
-			return ip, nil
-		}
+	for _, ip := range result.IPv4.Public {
+		logf("Got address of %s: %s", s, ip.Address)
+		return ip.Address, nil
 	}
-	return nil, fmt.Errorf("cannot find public IP for %s", s)
-}
-
-type linodeTemplateResult struct {
-	linodeResult
-	Data []*linodeTemplate
+	return "", fmt.Errorf("cannot find public IP for %s", s)
 }
 
 type linodeTemplate struct {
 	Name   string        `json:"-"`
 	Kernel *linodeKernel `json:"-"`
 
-	DistroID     int    `json:"DISTRIBUTIONID"`
-	ImageID      int    `json:"IMAGEID"`
-	Label        string `json:"LABEL"`
-	MinImageSize int    `json:"MINIMAGESIZE"`
-	VOPSKernel   int    `json:"REQUIRESVOPSKERNEL"`
-	Is64Bit      int    `json:"IS64BIT"`
-	Create       string `json:"CREATE_DT"`
-}
-
-type linodeKernelResult struct {
-	linodeResult
-	Data []*linodeKernel
+	ID         string `json:"id"`
+	Label      string `json:"label"`
+	IsPublic   bool   `json:"is_public"`
+	Deprecated bool   `json:"deprecated"`
+	Size       int    `json:"size"`
 }
 
 type linodeKernel struct {
-	ID      int    `json:"KERNELID"`
-	IsPVOPS int    `json:"ISPVOPS"`
-	IsXEN   int    `json:"ISXEN"`
-	IsKVM   int    `json:"ISKVM"`
-	Label   string `json:"LABEL"`
-}
-
-// Not listed for some reason.
-var linodeKernels = []*linodeKernel{{
-	ID:    210,
-	Label: "GRUB 2",
-	IsKVM: 1,
-}, {
-	ID:    213,
-	Label: "Direct Disk",
-	IsKVM: 1,
-}}
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	KVM   bool   `json:"kvm"`
+}
 
 func (p *linodeProvider) template(system *System) (*linodeTemplate, *linodeKernel, error) {
 	p.mu.Lock()
@@ -926,11 +871,11 @@ func (p *linodeProvider) template(system *System) (*linodeTemplate, *linodeKerne
 	var best *linodeTemplate
 	for _, template := range p.templatesCache {
 		label := strings.ToLower(template.Label)
-		if template.Name != system.Image && label != wantImage && !strings.HasPrefix(label, wantPrefix) {
+		if template.ID != system.Image && template.Name != system.Image && label != wantImage && !strings.HasPrefix(label, wantPrefix) {
 			continue
 		}
 		best = template
-		if template.ImageID > 0 || template.Is64Bit == 1 {
+		if !template.Deprecated {
 			break
 		}
 	}
@@ -942,7 +887,7 @@ func (p *linodeProvider) template(system *System) (*linodeTemplate, *linodeKerne
 		wantPrefix := wantKernel + " "
 		for _, kernel := range p.kernelsCache {
 			label := strings.ToLower(kernel.Label)
-			if label == wantKernel || strings.HasPrefix(label, wantPrefix) {
+			if kernel.ID == system.Kernel || label == wantKernel || strings.HasPrefix(label, wantPrefix) {
 				return best, kernel, nil
 			}
 		}
@@ -954,33 +899,17 @@ func (p *linodeProvider) template(system *System) (*linodeTemplate, *linodeKerne
 func (p *linodeProvider) cacheTemplates() error {
 	var err error
 	for retry := 0; retry < 3; retry++ {
-		params := linodeParams{
-			"api_action": "avail.distributions",
-		}
-		var result linodeTemplateResult
-		err = p.do(params, &result)
-		if err == nil {
-			err = result.err()
-		}
-		if err == nil {
-			p.templatesCache = result.Data
-			break
-		}
-	}
-	if err != nil {
-		return fmt.Errorf("cannot list Linode distributions: %v", err)
-	}
-	for retry := 0; retry < 3; retry++ {
-		params := linodeParams{
-			"api_action": "image.list",
-		}
-		var result linodeTemplateResult
-		err = p.do(params, &result)
-		if err == nil {
-			err = result.err()
-		}
+		var templates []*linodeTemplate
+		err = p.listAll("/images", func(data []byte) error {
+			var page []*linodeTemplate
+			if err := json.Unmarshal(data, &page); err != nil {
+				return fmt.Errorf("cannot decode Linode image list: %v", err)
+			}
+			templates = append(templates, page...)
+			return nil
+		})
 		if err == nil {
-			p.templatesCache = append(p.templatesCache, result.Data...)
+			p.templatesCache = templates
 			break
 		}
 	}
@@ -988,16 +917,17 @@ func (p *linodeProvider) cacheTemplates() error {
 		return fmt.Errorf("cannot list Linode images: %v", err)
 	}
 	for retry := 0; retry < 3; retry++ {
-		params := linodeParams{
-			"api_action": "avail.kernels",
-		}
-		var result linodeKernelResult
-		err = p.do(params, &result)
-		if err == nil {
-			err = result.err()
-		}
+		var kernels []*linodeKernel
+		err = p.listAll("/linode/kernels", func(data []byte) error {
+			var page []*linodeKernel
+			if err := json.Unmarshal(data, &page); err != nil {
+				return fmt.Errorf("cannot decode Linode kernel list: %v", err)
+			}
+			kernels = append(kernels, page...)
+			return nil
+		})
 		if err == nil {
-			p.kernelsCache = result.Data
+			p.kernelsCache = kernels
 			break
 		}
 	}
@@ -1005,18 +935,13 @@ func (p *linodeProvider) cacheTemplates() error {
 		return fmt.Errorf("cannot list Linode kernels: %v", err)
 	}
 
-	p.kernelsCache = append(p.kernelsCache, linodeKernels...)
-
-	var latest32, latest64 *linodeKernel
+	var latest *linodeKernel
 	for _, kernel := range p.kernelsCache {
-		if strings.HasPrefix(kernel.Label, "Latest 64 bit") {
-			latest64 = kernel
-		}
-		if strings.HasPrefix(kernel.Label, "Latest 32 bit") {
-			latest32 = kernel
+		if kernel.ID == "linode/latest-64bit" || latest == nil && strings.HasPrefix(kernel.Label, "Latest 64 bit") {
+			latest = kernel
 		}
 	}
-	if latest32 == nil || latest64 == nil {
+	if latest == nil {
 		return fmt.Errorf("cannot find latest Linode kernel")
 	}
 	for _, template := range p.templatesCache {
@@ -1028,18 +953,10 @@ func (p *linodeProvider) cacheTemplates() error {
 		} else if len(label) > 0 {
 			template.Name = label[0]
 		}
-
-		if strings.HasSuffix(template.Name, "-grub") {
-			// Deprecated logic. Drop after a short while.
-			template.Kernel = linodeKernels[0]
-		} else if template.Is64Bit == 1 || template.ImageID > 0 {
-			template.Kernel = latest64
-		} else {
-			template.Kernel = latest32
-		}
+		template.Kernel = latest
 	}
 
-	debugf("Linode distributions available: %# v", p.templatesCache)
+	debugf("Linode images available: %# v", p.templatesCache)
 	return nil
 }
 
@@ -1051,11 +968,7 @@ func (p *linodeProvider) checkKey() error {
 		return p.keyErr
 	}
 
-	var result linodeResult
-	err := p.do(linodeParams{"api_action": "test.echo"}, &result)
-	if err == nil {
-		err = result.err()
-	}
+	err := p.do("GET", "/profile", nil, nil)
 	if err != nil {
 		err = &FatalError{err}
 	}
@@ -1065,7 +978,21 @@ func (p *linodeProvider) checkKey() error {
 	return err
 }
 
-type linodeParams map[string]interface{}
+// linodeStatusError is returned for requests that fail with an HTTP
+// error status.
+type linodeStatusError struct {
+	code int
+	err  error
+}
+
+func (e *linodeStatusError) Error() string {
+	return e.err.Error()
+}
+
+func isLinodeNotFound(err error) bool {
+	e, ok := err.(*linodeStatusError)
+	return ok && e.code == http.StatusNotFound
+}
 
 type doFlags int
 
@@ -1073,36 +1000,41 @@ const (
 	noLog doFlags = 1
 )
 
-func (p *linodeProvider) do(params linodeParams, result interface{}) error {
-	return p.dofl(params, result, 0)
+func (p *linodeProvider) do(method, path string, params, result interface{}) error {
+	return p.dofl(method, path, params, result, 0)
 }
 
-func (p *linodeProvider) dofl(params linodeParams, result interface{}, flags doFlags) error {
+// dofl performs a request against the Linode API. Parameters are sent
+// as the JSON body of the request, or as the X-Filter header in
+// listing requests.
+func (p *linodeProvider) dofl(method, path string, params, result interface{}, flags doFlags) error {
 	log := flags&noLog == 0
 	if log {
-		debugf("Linode request: %# v\n", params)
-	}
-
-	values := make(url.Values)
-	for k, v := range params {
-		var vs string
-		switch v := v.(type) {
-		case int:
-			vs = strconv.Itoa(v)
-		case string:
-			vs = v
-		default:
-			data, err := json.Marshal(v)
-			if err != nil {
-				return fmt.Errorf("cannot marshal Linode request parameter %q: %s", k, err)
-			}
-			vs = string(data)
+		debugf("Linode request: %s %s %# v\n", method, path, params)
+	}
+
+	var body []byte
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("cannot marshal Linode request parameters: %s", err)
 		}
-		values[k] = []string{vs}
+		body = data
+	}
+	req, err := http.NewRequest(method, linodeAPI+path, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create Linode request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.backend.Key)
+	if _, ok := params.(linodeFilter); ok {
+		req.Header.Set("X-Filter", string(body))
+	} else if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Type", "application/json")
 	}
-	values["api_key"] = []string{p.backend.Key}
 
-	resp, err := client.PostForm("https://api.linode.com", values)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("cannot perform Linode request: %v", err)
 	}
@@ -1120,9 +1052,22 @@ func (p *linodeProvider) dofl(params linodeParams, result interface{}, flags doF
 		}
 	}
 
+	if resp.StatusCode >= 400 {
+		var errResult linodeResult
+		json.Unmarshal(data, &errResult)
+		err := errResult.err()
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return &linodeStatusError{resp.StatusCode, err}
+	}
+	if result == nil {
+		return nil
+	}
+
 	err = json.Unmarshal(data, result)
 	if err != nil {
-		info := pretty.Sprintf("Request:\n-----\n%# v\n-----\nResponse:\n-----\n%s\n-----\n", params, data)
+		info := pretty.Sprintf("Request:\n-----\n%s %s %# v\n-----\nResponse:\n-----\n%s\n-----\n", method, path, params, data)
 		return fmt.Errorf("cannot decode Linode response: %s\n%s", err, info)
 	}
 	return nil
@@ -1130,7 +1075,7 @@ func (p *linodeProvider) dofl(params linodeParams, result interface{}, flags doF
 
 func parseLinodeDT(dt string) time.Time {
 	if dt != "" {
-		t, err := time.Parse("2006-01-02 15:04:05.0", dt)
+		t, err := time.Parse("2006-01-02T15:04:05", dt)
 		if err == nil {
 			return t
 		}
@@ -0,0 +1,408 @@
+package spread_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+const linodeTimeFormat = "2006-01-02T15:04:05"
+
+type fakeLinodeInstance struct {
+	ID      int    `json:"id"`
+	Label   string `json:"label"`
+	Status  string `json:"status"`
+	Created string `json:"created"`
+
+	disks   []*fakeLinodeDisk
+	configs map[int]map[string]interface{}
+}
+
+type fakeLinodeDisk struct {
+	ID         int    `json:"id"`
+	Label      string `json:"label"`
+	Status     string `json:"status"`
+	Size       int    `json:"size"`
+	Filesystem string `json:"filesystem"`
+	Created    string `json:"created"`
+}
+
+type fakeLinodeEvent struct {
+	ID       int    `json:"id"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+	Created  string `json:"created"`
+	entityID int
+}
+
+// LinodeSuite runs the Linode provider against an in-process fake of
+// the relevant parts of the Linode v4 API.
+type LinodeSuite struct {
+	server  *httptest.Server
+	restore func()
+
+	mu        sync.Mutex
+	lastID    int
+	requests  []string
+	bodies    map[string][]map[string]interface{}
+	instances map[int]*fakeLinodeInstance
+	events    []*fakeLinodeEvent
+
+	// onDiskCreate is called with the lock held when a disk is created.
+	onDiskCreate func(inst *fakeLinodeInstance)
+}
+
+var _ = Suite(&LinodeSuite{})
+
+func (s *LinodeSuite) SetUpTest(c *C) {
+	s.lastID = 1000
+	s.requests = nil
+	s.bodies = make(map[string][]map[string]interface{})
+	s.instances = make(map[int]*fakeLinodeInstance)
+	s.events = nil
+	s.onDiskCreate = nil
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.restore = spread.FakeLinodeAPI(s.server.URL + "/v4")
+}
+
+func (s *LinodeSuite) TearDownTest(c *C) {
+	s.restore()
+	s.server.Close()
+}
+
+func (s *LinodeSuite) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *LinodeSuite) addInstance(label, status string) *fakeLinodeInstance {
+	inst := &fakeLinodeInstance{
+		ID:      s.nextID(),
+		Label:   label,
+		Status:  status,
+		configs: make(map[int]map[string]interface{}),
+	}
+	s.instances[inst.ID] = inst
+	return inst
+}
+
+func (s *LinodeSuite) addEvent(entityID int, action string, created time.Time) {
+	s.events = append(s.events, &fakeLinodeEvent{
+		ID:       s.nextID(),
+		Action:   action,
+		Status:   "finished",
+		Created:  created.UTC().Format(linodeTimeFormat),
+		entityID: entityID,
+	})
+}
+
+func (s *LinodeSuite) respond(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (s *LinodeSuite) fail(w http.ResponseWriter, code int, reason string) {
+	s.respond(w, code, map[string]interface{}{
+		"errors": []map[string]string{{"reason": reason}},
+	})
+}
+
+func (s *LinodeSuite) page(w http.ResponseWriter, data interface{}) {
+	s.respond(w, http.StatusOK, map[string]interface{}{
+		"data":  data,
+		"page":  1,
+		"pages": 1,
+	})
+}
+
+func (s *LinodeSuite) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v4")
+	request := req.Method + " " + path
+	s.requests = append(s.requests, request)
+
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		s.fail(w, http.StatusUnauthorized, "Invalid Token")
+		return
+	}
+	if req.Method == "POST" {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		s.bodies[request] = append(s.bodies[request], body)
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var inst *fakeLinodeInstance
+	if len(parts) > 2 && parts[0] == "linode" && parts[1] == "instances" {
+		id, _ := strconv.Atoi(parts[2])
+		inst = s.instances[id]
+		if inst == nil {
+			s.fail(w, http.StatusNotFound, "Not found")
+			return
+		}
+		parts = parts[3:]
+	}
+	now := time.Now().UTC()
+
+	switch {
+	case request == "GET /profile":
+		s.respond(w, http.StatusOK, map[string]string{"username": "spread"})
+	case request == "GET /images":
+		s.page(w, []map[string]interface{}{
+			{"id": "linode/ubuntu16.04lts", "label": "Ubuntu 16.04 LTS", "is_public": true, "deprecated": true},
+			{"id": "linode/ubuntu22.04", "label": "Ubuntu 22.04 LTS", "is_public": true},
+			{"id": "private/42", "label": "custom-image", "is_public": false},
+		})
+	case request == "GET /linode/kernels":
+		s.page(w, []map[string]interface{}{
+			{"id": "linode/latest-64bit", "label": "Latest 64 bit (6.2.9-x86_64-linode160)", "kvm": true},
+			{"id": "linode/grub2", "label": "GRUB 2", "kvm": true},
+		})
+	case request == "GET /linode/instances":
+		var ids []int
+		for id := range s.instances {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		var data []*fakeLinodeInstance
+		for _, id := range ids {
+			data = append(data, s.instances[id])
+		}
+		s.page(w, data)
+	case request == "GET /account/events":
+		var filter struct {
+			EntityID int `json:"entity.id"`
+		}
+		json.Unmarshal([]byte(req.Header.Get("X-Filter")), &filter)
+		var data []*fakeLinodeEvent
+		for i := len(s.events) - 1; i >= 0; i-- {
+			if s.events[i].entityID == filter.EntityID {
+				data = append(data, s.events[i])
+			}
+		}
+		s.page(w, data)
+	case inst == nil:
+		s.fail(w, http.StatusNotFound, "Not found")
+	case req.Method == "GET" && len(parts) == 0:
+		s.respond(w, http.StatusOK, inst)
+	case req.Method == "GET" && len(parts) == 1 && parts[0] == "ips":
+		s.respond(w, http.StatusOK, map[string]interface{}{
+			"ipv4": map[string]interface{}{
+				"public": []map[string]string{{"address": fmt.Sprintf("192.0.2.%d", inst.ID%256)}},
+			},
+		})
+	case req.Method == "GET" && len(parts) == 1 && parts[0] == "disks":
+		s.page(w, inst.disks)
+	case req.Method == "POST" && len(parts) == 1 && parts[0] == "disks":
+		body := s.bodies[request][len(s.bodies[request])-1]
+		size, _ := body["size"].(float64)
+		filesystem, _ := body["filesystem"].(string)
+		if filesystem == "" {
+			filesystem = "ext4"
+		}
+		disk := &fakeLinodeDisk{
+			ID:         s.nextID(),
+			Label:      body["label"].(string),
+			Status:     "ready",
+			Size:       int(size),
+			Filesystem: filesystem,
+			Created:    now.Format(linodeTimeFormat),
+		}
+		inst.disks = append(inst.disks, disk)
+		s.addEvent(inst.ID, "disk_create", now)
+		if s.onDiskCreate != nil {
+			s.onDiskCreate(inst)
+		}
+		s.respond(w, http.StatusOK, disk)
+	case len(parts) == 2 && parts[0] == "disks":
+		id, _ := strconv.Atoi(parts[1])
+		for i, disk := range inst.disks {
+			if disk.ID != id {
+				continue
+			}
+			if req.Method == "DELETE" {
+				inst.disks = append(inst.disks[:i], inst.disks[i+1:]...)
+				s.respond(w, http.StatusOK, map[string]interface{}{})
+			} else {
+				s.respond(w, http.StatusOK, disk)
+			}
+			return
+		}
+		s.fail(w, http.StatusNotFound, "Not found")
+	case req.Method == "POST" && len(parts) == 1 && parts[0] == "configs":
+		id := s.nextID()
+		inst.configs[id] = s.bodies[request][len(s.bodies[request])-1]
+		s.respond(w, http.StatusOK, map[string]interface{}{"id": id})
+	case req.Method == "DELETE" && len(parts) == 2 && parts[0] == "configs":
+		id, _ := strconv.Atoi(parts[1])
+		delete(inst.configs, id)
+		s.respond(w, http.StatusOK, map[string]interface{}{})
+	case req.Method == "POST" && len(parts) == 1 && parts[0] == "boot":
+		inst.Status = "running"
+		s.addEvent(inst.ID, "linode_boot", now)
+		s.respond(w, http.StatusOK, map[string]interface{}{})
+	case req.Method == "POST" && len(parts) == 1 && parts[0] == "shutdown":
+		inst.Status = "offline"
+		s.addEvent(inst.ID, "linode_shutdown", now)
+		s.respond(w, http.StatusOK, map[string]interface{}{})
+	default:
+		s.fail(w, http.StatusNotImplemented, "Not implemented")
+	}
+}
+
+func (s *LinodeSuite) provider(haltTimeout time.Duration) spread.Provider {
+	backend := &spread.Backend{
+		Name:        "linode",
+		Type:        "linode",
+		Key:         "secret-token",
+		HaltTimeout: spread.Timeout{Duration: haltTimeout},
+	}
+	return spread.Linode(&spread.Project{}, backend, &spread.Options{Password: "secret"})
+}
+
+var linodeSystem = &spread.System{Backend: "linode", Name: "ubuntu-22.04", Image: "ubuntu-22.04"}
+
+func (s *LinodeSuite) TestAllocateDiscard(c *C) {
+	inst := s.addInstance("spread-1", "offline")
+	s.addInstance("spread-2", "running")
+
+	server, err := s.provider(0).Allocate(linodeSystem)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, "192.0.2.233")
+	c.Assert(server.String(), Equals, "linode:ubuntu-22.04 (spread-1)")
+	c.Assert(inst.Status, Equals, "running")
+	c.Assert(inst.disks, HasLen, 2)
+	c.Assert(inst.configs, HasLen, 1)
+
+	disks := s.bodies["POST /linode/instances/1001/disks"]
+	c.Assert(disks, HasLen, 2)
+	c.Assert(disks[0]["image"], Equals, "linode/ubuntu22.04")
+	c.Assert(disks[0]["root_pass"], Equals, "secret")
+	c.Assert(disks[1]["filesystem"], Equals, "swap")
+	for _, config := range inst.configs {
+		c.Assert(config["kernel"], Equals, "linode/latest-64bit")
+		c.Assert(config["devices"], DeepEquals, map[string]interface{}{
+			"sda": map[string]interface{}{"disk_id": float64(inst.disks[0].ID)},
+			"sdb": map[string]interface{}{"disk_id": float64(inst.disks[1].ID)},
+		})
+	}
+
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(inst.Status, Equals, "offline")
+	c.Assert(inst.disks, HasLen, 0)
+	c.Assert(inst.configs, HasLen, 0)
+}
+
+func (s *LinodeSuite) TestAllocateKey(c *C) {
+	backend := &spread.Backend{Name: "linode", Type: "linode", Key: "secret-token"}
+	options := &spread.Options{Password: "secret", PublicKey: "ecdsa-sha2-nistp256 AAAA"}
+	provider := spread.Linode(&spread.Project{}, backend, options)
+
+	tests := []struct {
+		image string
+		keyed bool
+	}{
+		{"ubuntu-22.04", true},
+		{"custom-image", false},
+	}
+	s.addInstance("spread-1", "offline")
+	for _, test := range tests {
+		system := &spread.System{Backend: "linode", Name: "some-system", Image: test.image}
+		server, err := provider.Allocate(system)
+		c.Assert(err, IsNil)
+
+		disks := s.bodies["POST /linode/instances/1001/disks"]
+		c.Assert(disks[len(disks)-2]["authorized_keys"], DeepEquals, []interface{}{"ecdsa-sha2-nistp256 AAAA"})
+
+		// Custom images may not honor authorized_keys.
+		c.Assert(server.(spread.KeyServer).KeyAuthorized(), Equals, test.keyed, Commentf("Image: %s", test.image))
+		c.Assert(server.Discard(), IsNil)
+	}
+}
+
+func (s *LinodeSuite) TestAllocateNoServers(c *C) {
+	s.addInstance("spread-1", "running")
+
+	_, err := s.provider(0).Allocate(linodeSystem)
+	c.Assert(err, ErrorMatches, "no powered off servers in Linode account")
+}
+
+func (s *LinodeSuite) TestInvalidToken(c *C) {
+	backend := &spread.Backend{Name: "linode", Type: "linode", Key: "bad-token"}
+	provider := spread.Linode(&spread.Project{}, backend, &spread.Options{})
+
+	_, err := provider.Allocate(linodeSystem)
+	c.Assert(err, ErrorMatches, "invalid Token")
+	c.Assert(err, FitsTypeOf, &spread.FatalError{})
+}
+
+func (s *LinodeSuite) TestConcurrentDisk(c *C) {
+	inst := s.addInstance("spread-1", "offline")
+	inst.disks = append(inst.disks, &fakeLinodeDisk{
+		ID:      s.nextID(),
+		Label:   "other",
+		Status:  "ready",
+		Created: time.Now().UTC().Add(-30 * time.Second).Format(linodeTimeFormat),
+	})
+
+	_, err := s.provider(0).Allocate(linodeSystem)
+	c.Assert(err, ErrorMatches, `server linode:ubuntu-22.04 \(spread-1\) concurrently allocated, giving up on it`)
+	c.Assert(inst.disks, HasLen, 1)
+	c.Assert(inst.disks[0].Label, Equals, "other")
+	c.Assert(inst.Status, Equals, "offline")
+}
+
+func (s *LinodeSuite) TestConcurrentBoot(c *C) {
+	inst := s.addInstance("spread-1", "offline")
+	s.addEvent(inst.ID, "linode_shutdown", time.Now().Add(-time.Hour))
+	s.onDiskCreate = func(inst *fakeLinodeInstance) {
+		// Someone else boots the server meanwhile.
+		s.addEvent(inst.ID, "linode_boot", time.Now())
+		s.onDiskCreate = nil
+	}
+
+	_, err := s.provider(0).Allocate(linodeSystem)
+	c.Assert(err, ErrorMatches, `server linode:ubuntu-22.04 \(spread-1\) has external boot activity, giving up on it`)
+	c.Assert(inst.disks, HasLen, 0)
+	c.Assert(inst.configs, HasLen, 0)
+}
+
+func (s *LinodeSuite) TestHaltTimeout(c *C) {
+	old := s.addInstance("spread-1", "running")
+	recent := s.addInstance("spread-2", "running")
+	s.addEvent(old.ID, "linode_boot", time.Now().Add(-2*time.Hour))
+	s.addEvent(recent.ID, "linode_boot", time.Now().Add(-time.Minute))
+
+	_, err := s.provider(0).Allocate(linodeSystem)
+	c.Assert(err, ErrorMatches, "no powered off servers in Linode account")
+
+	server, err := s.provider(time.Hour).Allocate(linodeSystem)
+	c.Assert(err, IsNil)
+	c.Assert(server.String(), Equals, "linode:ubuntu-22.04 (spread-1)")
+	c.Assert(old.Status, Equals, "running")
+	c.Assert(old.disks, HasLen, 2)
+	c.Assert(recent.disks, HasLen, 0)
+
+	var actions []string
+	for _, event := range s.events {
+		if event.entityID == old.ID {
+			actions = append(actions, event.Action)
+		}
+	}
+	c.Assert(actions, DeepEquals, []string{"linode_boot", "linode_shutdown", "disk_create", "disk_create", "linode_boot"})
+
+	c.Assert(server.Discard(), IsNil)
+}
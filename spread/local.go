@@ -0,0 +1,313 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterProvider("local", Local)
+	RegisterValidator("local", validateLocal)
+	RegisterFields("local", "temp-dir")
+}
+
+func Local(p *Project, b *Backend, o *Options) Provider {
+	return &localProvider{p, b, o}
+}
+
+type localProvider struct {
+	project *Project
+	backend *Backend
+	options *Options
+}
+
+type localServer struct {
+	p *localProvider
+	d localServerData
+
+	system *System
+
+	// unpacked reports whether the project was unpacked straight
+	// into the remote project path, which must then be cleaned up
+	// on discard since no temporary directory holds it.
+	unpacked bool
+}
+
+type localServerData struct {
+	Dir string
+}
+
+func (s *localServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.system, s.Address())
+}
+
+func (s *localServer) Provider() Provider {
+	return s.p
+}
+
+// Address returns the temporary directory the server runs tasks in,
+// or localhost if tasks run directly on the remote project path.
+func (s *localServer) Address() string {
+	if s.d.Dir != "" {
+		return s.d.Dir
+	}
+	return "localhost"
+}
+
+func (s *localServer) System() *System {
+	return s.system
+}
+
+func (s *localServer) ReuseData() interface{} {
+	return &s.d
+}
+
+func (s *localServer) Discard() error {
+	if s.d.Dir == "" {
+		if !s.unpacked {
+			return nil
+		}
+		if err := os.RemoveAll(s.p.project.RemotePath); err != nil {
+			return fmt.Errorf("cannot remove local project data: %v", err)
+		}
+		s.unpacked = false
+		return nil
+	}
+	if err := os.RemoveAll(s.d.Dir); err != nil {
+		return fmt.Errorf("cannot remove local directory: %v", err)
+	}
+	return nil
+}
+
+func (s *localServer) Executor() (Executor, error) {
+	return &localExecutor{server: s}, nil
+}
+
+func (p *localProvider) Backend() *Backend {
+	return p.backend
+}
+
+func validateLocal(p *Project, b *Backend) error {
+	if b.TempDir {
+		return nil
+	}
+	// Without temp-dir every system runs in the same remote project
+	// path of the same local system, so they'd step on each other.
+	if names := b.systemNames(); len(names) > 1 {
+		return fmt.Errorf("%s requires temp-dir to have multiple systems (%s)", b, strings.Join(names, ", "))
+	}
+	for _, sysname := range b.systemNames() {
+		if b.Systems[sysname].Workers > 1 {
+			return fmt.Errorf("%s requires temp-dir for system %q to have multiple workers", b, sysname)
+		}
+	}
+	return nil
+}
+
+func (p *localProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error) {
+	s := &localServer{
+		p:      p,
+		system: system,
+		// Reused servers had the project sent by an earlier run.
+		unpacked: true,
+	}
+	err := rsystem.UnmarshalData(&s.d)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal local reuse data: %v", err)
+	}
+	if s.d.Dir != "" {
+		if _, err := os.Stat(s.d.Dir); err != nil {
+			return s, fmt.Errorf("cannot reuse local directory: %v", err)
+		}
+	}
+	return s, nil
+}
+
+func (p *localProvider) Allocate(system *System) (Server, error) {
+	s := &localServer{
+		p:      p,
+		system: system,
+	}
+	if p.backend.TempDir {
+		dir, err := ioutil.TempDir("", "spread-local-")
+		if err != nil {
+			return nil, &FatalError{fmt.Errorf("cannot create local directory: %v", err)}
+		}
+		s.d.Dir = dir
+	}
+	printf("Allocated %s.", s)
+	return s, nil
+}
+
+// localExecutor runs scripts directly on the local system. If the
+// server has its own directory, the remote project path is mapped
+// into it so that workers do not step on each other.
+type localExecutor struct {
+	server *localServer
+
+	warnTimeout time.Duration
+	killTimeout time.Duration
+}
+
+func (e *localExecutor) Server() Server {
+	return e.server
+}
+
+func (e *localExecutor) Close() error {
+	return nil
+}
+
+func (e *localExecutor) SetWarnTimeout(timeout time.Duration) {
+	e.warnTimeout = timeout
+}
+
+func (e *localExecutor) SetKillTimeout(timeout time.Duration) {
+	e.killTimeout = timeout
+}
+
+// path returns the local path that path in the remote project
+// path refers to.
+func (e *localExecutor) path(path string) string {
+	dir := e.server.d.Dir
+	remote := e.server.p.project.RemotePath
+	if dir == "" || path == "" {
+		return path
+	}
+	if path == remote || strings.HasPrefix(path, remote+"/") {
+		return filepath.Join(dir, strings.TrimPrefix(path, remote))
+	}
+	return path
+}
+
+func (e *localExecutor) env(env *Environment) *Environment {
+	if env == nil {
+		env = NewEnvironment()
+	} else {
+		env = env.Copy()
+	}
+	if env.Get("SPREAD_PATH") != "" {
+		env.Set("SPREAD_PATH", e.path(e.server.p.project.RemotePath))
+	}
+	return env
+}
+
+func (e *localExecutor) Trace(script string, dir string, env *Environment) (output []byte, err error) {
+	lscript := localScript{
+		script:      script,
+		dir:         e.path(dir),
+		env:         e.env(env),
+		warnTimeout: e.warnTimeout,
+		killTimeout: e.killTimeout,
+		mode:        traceOutput,
+	}
+	output, _, err = lscript.run()
+	return output, err
+}
+
+func (e *localExecutor) Shell(script string, dir string, env *Environment) error {
+	var buf bytes.Buffer
+	buf.WriteString(matchFunc)
+	env = e.env(env)
+	for _, k := range env.Keys() {
+		v := env.Get(k)
+		if len(v) == 0 || v[0] == '"' || v[0] == '\'' {
+			fmt.Fprintf(&buf, "export %s=%s\n", k, v)
+		} else {
+			fmt.Fprintf(&buf, "export %s=\"%s\"\n", k, v)
+		}
+	}
+	if script = strings.TrimSpace(script); script != "" {
+		fmt.Fprintf(&buf, "%s\n", script)
+	}
+
+	rcfile, err := ioutil.TempFile("", "spread-shell-")
+	if err != nil {
+		return fmt.Errorf("cannot create local shell rc file: %v", err)
+	}
+	defer os.Remove(rcfile.Name())
+	_, err = rcfile.Write(buf.Bytes())
+	rcfile.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write local shell rc file: %v", err)
+	}
+
+	cmd := exec.Command("/bin/bash", "--rcfile", rcfile.Name(), "-i")
+	cmd.Dir = e.path(dir)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	termLock()
+	err = cmd.Run()
+	termUnlock()
+	return err
+}
+
+func (e *localExecutor) RemoveAll(path string) error {
+	return os.RemoveAll(e.path(path))
+}
+
+func (e *localExecutor) MissingOrEmpty(dir string) (bool, error) {
+	f, err := os.Open(e.path(dir))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot check if %s is empty: %v", dir, err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot check if %s is empty: %v", dir, err)
+	}
+	debugf("Found %q inside %q, considering non-empty.", names[0], dir)
+	return false, nil
+}
+
+func (e *localExecutor) SendTar(tar io.Reader, unpackDir string) error {
+	empty, err := e.MissingOrEmpty(unpackDir)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("local directory %s is not empty", e.path(unpackDir))
+	}
+	dir := e.path(unpackDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create local directory: %v", err)
+	}
+	if e.server.d.Dir == "" && unpackDir == e.server.p.project.RemotePath {
+		e.server.unpacked = true
+	}
+
+	cmd := exec.Command("/bin/tar", "xz")
+	cmd.Dir = dir
+	cmd.Stdin = tar
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return outputErr(output, err)
+	}
+	return nil
+}
+
+func (e *localExecutor) RecvTar(packDir string, include []string, tar io.Writer) error {
+	var stderr bytes.Buffer
+	args := append([]string{"-c", recvTarScript, "--", e.path(packDir)}, include...)
+	cmd := exec.Command("/bin/bash", args...)
+	cmd.Stdout = tar
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return outputErr(stderr.Bytes(), err)
+	}
+	return nil
+}
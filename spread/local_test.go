@@ -0,0 +1,199 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LocalSuite struct {
+	dir string
+}
+
+var _ = Suite(&LocalSuite{})
+
+func (s *LocalSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *LocalSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+const localProject = `
+project: local-test
+path: /spread-local-test
+backends:
+    local:
+        temp-dir: true
+        systems:
+            - local-host:
+                workers: 2
+prepare: |
+    touch $SPREAD_PATH/prepared
+suites:
+    tests/:
+        summary: Local tests
+`
+
+func (s *LocalSuite) TestRun(c *C) {
+	s.write(c, "spread.yaml", localProject)
+	s.write(c, "tests/good/task.yaml", `
+summary: Good task
+artifacts: [output]
+execute: |
+    test -f $SPREAD_PATH/prepared
+    test -f $SPREAD_PATH/tests/good/task.yaml
+    test "$PWD" = "$SPREAD_PATH/tests/good"
+    echo good > output
+`)
+	s.write(c, "tests/bad/task.yaml", `
+summary: Bad task
+execute: |
+    exit 1
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	artifacts := filepath.Join(s.dir, "artifacts")
+	runner, err := spread.Start(project, &spread.Options{Artifacts: artifacts})
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), ErrorMatches, "unsuccessful run")
+
+	lastRun, err := spread.ReadLastRun(project)
+	c.Assert(err, IsNil)
+	c.Assert(lastRun.Jobs, DeepEquals, map[string]string{
+		"local:local-host:tests/good": spread.OutcomeDone,
+		"local:local-host:tests/bad":  spread.OutcomeError,
+	})
+
+	data, err := ioutil.ReadFile(filepath.Join(artifacts, "local:local-host:tests/good", "output"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "good\n")
+
+	// Nothing was written to the remote path on the host itself.
+	_, err = os.Stat(project.RemotePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// The reuse file and run key are gone with the servers.
+	leftover, err := filepath.Glob(filepath.Join(s.dir, ".spread-reuse.*"))
+	c.Assert(err, IsNil)
+	c.Assert(leftover, HasLen, 0)
+}
+
+func (s *LocalSuite) TestWorkersNeedTempDir(c *C) {
+	s.write(c, "spread.yaml", `
+project: local-test
+path: /spread-local-test
+backends:
+    local:
+        systems:
+            - local-host:
+                workers: 2
+suites:
+    tests/:
+        summary: Local tests
+`)
+	_, err := spread.Load(s.dir)
+	c.Assert(err, ErrorMatches, `backend "local" requires temp-dir for system "local-host" to have multiple workers`)
+}
+
+func (s *LocalSuite) TestSystemsNeedTempDir(c *C) {
+	s.write(c, "spread.yaml", `
+project: local-test
+path: /spread-local-test
+backends:
+    local:
+        systems:
+            - local-one
+            - local-two
+suites:
+    tests/:
+        summary: Local tests
+`)
+	_, err := spread.Load(s.dir)
+	c.Assert(err, ErrorMatches, `backend "local" requires temp-dir to have multiple systems \(local-one, local-two\)`)
+}
+
+func (s *LocalSuite) TestRunTwiceWithoutTempDir(c *C) {
+	remote := filepath.Join(c.MkDir(), "remote")
+	s.write(c, "spread.yaml", `
+project: local-test
+path: `+remote+`
+backends:
+    local:
+        systems:
+            - local-host
+suites:
+    tests/:
+        summary: Local tests
+`)
+	s.write(c, "tests/good/task.yaml", `
+summary: Good task
+execute: |
+    test "$PWD" = "`+remote+`/tests/good"
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	// The project is unpacked straight into the remote path, which
+	// must be clean again for the next run.
+	for i := 0; i < 2; i++ {
+		runner, err := spread.Start(project, &spread.Options{})
+		c.Assert(err, IsNil)
+		c.Assert(runner.Wait(), IsNil, Commentf("Run %d", i+1))
+		_, err = os.Stat(remote)
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *LocalSuite) TestRetryFresh(c *C) {
+	attempts := filepath.Join(s.dir, "attempts")
+	s.write(c, "spread.yaml", `
+project: local-test
+path: /spread-local-test
+backends:
+    local:
+        temp-dir: true
+        systems:
+            - local-host
+suites:
+    tests/:
+        summary: Local tests
+`)
+	s.write(c, "tests/flaky/task.yaml", `
+summary: Flaky task
+execute: |
+    echo $SPREAD_PATH >> `+attempts+`
+    test $(wc -l < `+attempts+`) -gt 1
+`)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+
+	runner, err := spread.Start(project, &spread.Options{Retries: 1, RetryFresh: true})
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), IsNil)
+
+	lastRun, err := spread.ReadLastRun(project)
+	c.Assert(err, IsNil)
+	c.Assert(lastRun.Jobs, DeepEquals, map[string]string{
+		"local:local-host:tests/flaky": spread.OutcomeFlaky,
+	})
+
+	// Each attempt ran on its own server.
+	data, err := ioutil.ReadFile(attempts)
+	c.Assert(err, IsNil)
+	paths := strings.Fields(string(data))
+	c.Assert(paths, HasLen, 2)
+	c.Assert(paths[0], Not(Equals), paths[1])
+}
@@ -1,27 +1,34 @@
 package spread
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+func init() {
+	RegisterProvider("lxd", LXD)
+	RegisterFields("lxd", "remote", "vm", "profiles", "config", "devices")
+}
+
 func LXD(p *Project, b *Backend, o *Options) Provider {
-	return &lxdProvider{p, b, o}
+	return &lxdProvider{project: p, backend: b, options: o}
 }
 
 type lxdProvider struct {
 	project *Project
 	backend *Backend
 	options *Options
+
+	mu        sync.Mutex
+	clientObj *lxdClient
 }
 
 type lxdServer struct {
@@ -56,14 +63,46 @@ func (s *lxdServer) ReuseData() interface{} {
 	return &s.d
 }
 
+func (s *lxdServer) KeyAuthorized() bool {
+	return s.p.options.PublicKey != ""
+}
+
 func (s *lxdServer) Discard() error {
-	output, err := exec.Command("lxc", "delete", "--force", s.d.Name).CombinedOutput()
+	client, err := s.p.client()
 	if err != nil {
-		return fmt.Errorf("cannot discard lxd container: %v", outputErr(output, err))
+		return fmt.Errorf("cannot discard lxd instance: %v", err)
+	}
+	// Ephemeral containers are deleted once stopped.
+	err = client.setState(s.d.Name, &lxdStatePut{Action: "stop", Timeout: lxdStateTimeout, Force: true})
+	if err == nil || !isLXDNotFound(err) {
+		err = client.delete(s.d.Name)
+	}
+	if err != nil && !isLXDNotFound(err) {
+		return fmt.Errorf("cannot discard lxd instance: %v", err)
 	}
 	return nil
 }
 
+// Snapshot saves the filesystem of the instance under the given name.
+// Snapshots are removed along with the instance once it is discarded.
+func (s *lxdServer) Snapshot(name string) error {
+	client, err := s.p.client()
+	if err != nil {
+		return err
+	}
+	return client.snapshot(s.d.Name, name)
+}
+
+// RestoreSnapshot restores the instance to the snapshot saved under
+// the given name, restarting it.
+func (s *lxdServer) RestoreSnapshot(name string) error {
+	client, err := s.p.client()
+	if err != nil {
+		return err
+	}
+	return client.restore(s.d.Name, name)
+}
+
 func (p *lxdProvider) Backend() *Backend {
 	return p.backend
 }
@@ -81,24 +120,51 @@ func (p *lxdProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error
 	return s, nil
 }
 
+// client returns the client for the daemon the backend is configured
+// to use, creating it on first use.
+func (p *lxdProvider) client() (*lxdClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clientObj == nil {
+		client, err := newLXDClient(p.backend.Remote)
+		if err != nil {
+			return nil, err
+		}
+		p.clientObj = client
+	}
+	return p.clientObj, nil
+}
+
 func (p *lxdProvider) Allocate(system *System) (Server, error) {
+	client, err := p.client()
+	if err != nil {
+		return nil, &FatalError{err}
+	}
 	lxdimage := p.lxdImage(system)
+	source, err := client.imageSource(lxdimage)
+	if err != nil {
+		return nil, &FatalError{err}
+	}
 	name, err := lxdName(system)
 	if err != nil {
 		return nil, err
 	}
 
-	args := []string{"launch", lxdimage, name}
-	if !p.options.Reuse {
-		args = append(args, "--ephemeral")
+	post := &lxdInstancesPost{
+		Name:      name,
+		Type:      "container",
+		Ephemeral: !p.options.Reuse,
+		Profiles:  system.Profiles,
+		Config:    system.Config,
+		Devices:   system.Devices,
+		Source:    source,
 	}
-	output, err := exec.Command("lxc", args...).CombinedOutput()
+	if system.VM {
+		post.Type = "virtual-machine"
+	}
+	err = client.create(post)
 	if err != nil {
-		err = outputErr(output, err)
-		if bytes.Contains(output, []byte("error: not found")) {
-			err = fmt.Errorf("%s not found", lxdimage)
-		}
-		return nil, &FatalError{fmt.Errorf("cannot launch lxd container: %v", err)}
+		return nil, &FatalError{fmt.Errorf("cannot launch lxd %s from %s: %v", post.Type, lxdimage, err)}
 	}
 
 	s := &lxdServer{
@@ -109,27 +175,24 @@ func (p *lxdProvider) Allocate(system *System) (Server, error) {
 		system: system,
 	}
 
-	printf("Waiting for lxd container %s to have an address...", name)
-	timeout := time.After(10 * time.Second)
-	retry := time.NewTicker(1 * time.Second)
-	defer retry.Stop()
-	for {
-		addr, err := p.address(name)
-		if err == nil {
-			s.address = addr
-			break
-		}
-		if _, ok := err.(*lxdNoAddrError); !ok {
-			s.Discard()
-			return nil, err
-		}
+	err = client.setState(name, &lxdStatePut{Action: "start", Timeout: lxdStateTimeout})
+	if err != nil {
+		s.Discard()
+		return nil, &FatalError{fmt.Errorf("cannot start lxd %s: %v", post.Type, err)}
+	}
 
-		select {
-		case <-retry.C:
-		case <-timeout:
-			s.Discard()
-			return nil, err
-		}
+	// The instance only gets an address once its network is up, which
+	// happens some time after the start operation is done.
+	printf("Waiting for lxd %s %s to have an address...", post.Type, name)
+	err = p.waitNetwork(name, system.VM)
+	if err != nil {
+		s.Discard()
+		return nil, err
+	}
+	s.address, err = p.address(name, system)
+	if err != nil {
+		s.Discard()
+		return nil, err
 	}
 
 	err = p.tuneSSH(name)
@@ -204,91 +267,110 @@ func lxdName(system *System) (string, error) {
 	return fmt.Sprintf("spread-%d-%s", n, strings.Replace(system.Name, ".", "-", -1)), nil
 }
 
-type lxdServerJSON struct {
-	Name  string `json:"name"`
-	State struct {
-		Network map[string]lxdDeviceJSON `json:"network"`
-	} `json:"state"`
-}
-
-type lxdDeviceJSON struct {
-	State     string           `json:"state"`
-	Addresses []lxdAddressJSON `json:"addresses"`
-}
-
-type lxdAddressJSON struct {
-	Family  string `json:"family"`
-	Address string `json:"address"`
-}
-
-type lxdNoServerError struct {
-	name string
-}
-
-func (e *lxdNoServerError) Error() string {
-	return fmt.Sprintf("cannot find lxd server %q", e.name)
-}
-
-type lxdNoAddrError struct {
-	name string
-}
-
-func (e *lxdNoAddrError) Error() string {
-	return fmt.Sprintf("lxd server %s has no address available", e.name)
-}
-
-func (p *lxdProvider) address(name string) (string, error) {
-	sjson, err := p.serverJSON(name)
+// lxdNetworkScript exits successfully once the instance has a default
+// route, which it only gets after its network is configured, and fails
+// if that takes longer than a minute.
+const lxdNetworkScript = `
+n=0
+while [ $n -lt 120 ]; do
+	while read -r iface dest rest; do
+		[ "$dest" = 00000000 ] && exit 0
+	done < /proc/net/route
+	n=$((n+1))
+	sleep 0.5
+done
+exit 1
+`
+
+// lxdAgentTimeout is how long virtual machines may take to boot and
+// start the LXD agent, which runs commands on them.
+const lxdAgentTimeout = 3 * time.Minute
+
+// waitNetwork waits until the network of the named instance is up. The
+// waiting happens inside the instance, in an exec operation that is
+// waited on like any other. Commands can only run on virtual machines
+// once their agent is up, so those are retried until then.
+func (p *lxdProvider) waitNetwork(name string, vm bool) error {
+	client, err := p.client()
 	if err != nil {
-		return "", err
+		return err
 	}
-	for _, addr := range sjson.State.Network["eth0"].Addresses {
-		if addr.Family == "inet" && addr.Address != "" {
-			return addr.Address, nil
+	timeout := time.Now().Add(lxdAgentTimeout)
+	for {
+		output, err := client.exec(name, []string{"/bin/sh", "-c", lxdNetworkScript})
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*lxdError); !ok || !vm || time.Now().After(timeout) {
+			return fmt.Errorf("cannot wait for network of lxd instance %q: %v", name, outputErr(output, err))
 		}
+		debugf("Cannot run commands on lxd virtual machine %s yet: %v", name, err)
+		time.Sleep(time.Second)
 	}
-	return "", &lxdNoAddrError{name}
 }
 
-func (p *lxdProvider) serverJSON(name string) (*lxdServerJSON, error) {
-	var stderr bytes.Buffer
-	cmd := exec.Command("lxc", "list", "--format=json", name)
-	cmd.Stderr = &stderr
+// lxdVirtualIfaces are prefixes of interfaces set up by software such as
+// docker or libvirt inside the instance, which never hold its address.
+var lxdVirtualIfaces = []string{"docker", "lxdbr", "virbr"}
 
-	output, err := cmd.Output()
+func (p *lxdProvider) address(name string, system *System) (string, error) {
+	client, err := p.client()
 	if err != nil {
-		err = outputErr(stderr.Bytes(), err)
-		return nil, fmt.Errorf("cannot list lxd container: %v", err)
+		return "", err
 	}
-
-	var sjsons []*lxdServerJSON
-	err = json.Unmarshal(output, &sjsons)
+	state, err := client.state(name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot unmarshal lxd list output: %v", err)
+		return "", fmt.Errorf("cannot get state of lxd instance: %v", err)
 	}
-
-	debugf("lxd list output: %# v\n", sjsons)
-
-	if len(sjsons) == 0 {
-		return nil, &lxdNoServerError{name}
+	debugf("lxd state of %s: %# v", name, state)
+
+	// Prefer the interfaces named by the nic devices of the system,
+	// then eth0, and otherwise the first other interface by name, as
+	// virtual machines usually have names such as enp5s0.
+	var preferred, ifaces []string
+	for _, device := range system.Devices {
+		if device["type"] == "nic" && device["name"] != "" {
+			preferred = append(preferred, device["name"])
+		}
 	}
-	if sjsons[0].Name != name {
-		return nil, fmt.Errorf("lxd returned invalid JSON listing for %q: %s", name, outputErr(output, nil))
+	sort.Strings(preferred)
+	preferred = append(preferred, "eth0")
+	for iface, device := range state.Network {
+		if device.Type != "loopback" && iface != "lo" && !lxdVirtualIface(iface) {
+			ifaces = append(ifaces, iface)
+		}
 	}
-	return sjsons[0], nil
+	sort.Strings(ifaces)
+	ifaces = append(preferred, ifaces...)
+	for _, iface := range ifaces {
+		for _, addr := range state.Network[iface].Addresses {
+			if addr.Family == "inet" && addr.Address != "" && (addr.Scope == "" || addr.Scope == "global") {
+				return addr.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("lxd instance %s has no address available", name)
 }
 
-func (p *lxdProvider) tuneSSH(name string) error {
-	cmds := [][]string{
-		{"sed", "-i", `s/\(PermitRootLogin\|PasswordAuthentication\)\>.*/\1 yes/`, "/etc/ssh/sshd_config"},
-		{"/bin/bash", "-c", fmt.Sprintf("echo root:'%s' | chpasswd", p.options.Password)},
-		{"killall", "-HUP", "sshd"},
-	}
-	for _, args := range cmds {
-		output, err := exec.Command("lxc", append([]string{"exec", name, "--"}, args...)...).CombinedOutput()
-		if err != nil && args[0] != "killall" {
-			return fmt.Errorf("cannot prepare sshd in lxd container %q: %v", name, outputErr(output, err))
+func lxdVirtualIface(iface string) bool {
+	for _, prefix := range lxdVirtualIfaces {
+		if strings.HasPrefix(iface, prefix) {
+			return true
 		}
 	}
+	return false
+}
+
+func (p *lxdProvider) tuneSSH(name string) error {
+	client, err := p.client()
+	if err != nil {
+		return err
+	}
+	err = tuneSSH(func(args []string) ([]byte, error) {
+		return client.exec(name, args)
+	}, p.options.Password, p.options.PublicKey)
+	if err != nil {
+		return fmt.Errorf("cannot prepare sshd in lxd instance %q: %v", name, err)
+	}
 	return nil
 }
@@ -0,0 +1,279 @@
+package spread_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LXDSuite struct {
+	server *http.Server
+	env    map[string]string
+
+	mu       sync.Mutex
+	requests []string
+	created  map[string]interface{}
+	commands [][]string
+	ops      map[string]interface{}
+	network  map[string]interface{}
+
+	// agentDown is how many more commands fail to run as if the
+	// agent of a virtual machine was not up yet.
+	agentDown int
+}
+
+var _ = Suite(&LXDSuite{})
+
+func (s *LXDSuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	s.env = make(map[string]string)
+	for _, name := range []string{"HOME", "LXD_DIR", "LXD_CONF"} {
+		s.env[name] = os.Getenv(name)
+		os.Setenv(name, dir)
+	}
+	s.requests = nil
+	s.created = nil
+	s.commands = nil
+	s.agentDown = 0
+	s.ops = make(map[string]interface{})
+	s.network = map[string]interface{}{
+		"lo": map[string]interface{}{
+			"type":      "loopback",
+			"addresses": []map[string]string{{"family": "inet", "address": "127.0.0.1", "scope": "local"}},
+		},
+		"eth0": map[string]interface{}{
+			"type": "broadcast",
+			"addresses": []map[string]string{
+				{"family": "inet6", "address": "fe80::1", "scope": "link"},
+				{"family": "inet", "address": "10.0.0.2", "scope": "global"},
+			},
+		},
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "unix.socket"))
+	c.Assert(err, IsNil)
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	go s.server.Serve(l)
+}
+
+func (s *LXDSuite) TearDownTest(c *C) {
+	s.server.Close()
+	for name, value := range s.env {
+		os.Setenv(name, value)
+	}
+}
+
+func (s *LXDSuite) respond(w http.ResponseWriter, typ string, code int, metadata interface{}) {
+	resp := map[string]interface{}{"type": typ, "metadata": metadata}
+	if typ == "error" {
+		resp["error_code"] = code
+		resp["error"] = http.StatusText(code)
+	} else {
+		resp["status_code"] = code
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *LXDSuite) async(w http.ResponseWriter, metadata interface{}) {
+	id := fmt.Sprintf("op%d", len(s.ops)+1)
+	s.ops[id] = metadata
+	resp := map[string]interface{}{"type": "async", "status_code": 100, "operation": "/1.0/operations/" + id}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *LXDSuite) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/1.0/instances":
+		json.NewDecoder(req.Body).Decode(&s.created)
+		s.async(w, nil)
+	case req.Method == "GET" && len(path) == 4 && path[1] == "operations" && path[3] == "wait":
+		s.respond(w, "sync", http.StatusOK, map[string]interface{}{
+			"id":          path[2],
+			"status":      "Success",
+			"status_code": http.StatusOK,
+			"metadata":    s.ops[path[2]],
+		})
+	case req.Method == "PUT" && len(path) == 4 && path[3] == "state":
+		s.async(w, nil)
+	case req.Method == "GET" && len(path) == 4 && path[3] == "state":
+		s.respond(w, "sync", http.StatusOK, map[string]interface{}{
+			"status":  "Running",
+			"network": s.network,
+		})
+	case req.Method == "POST" && len(path) == 4 && path[3] == "exec":
+		var exec struct{ Command []string }
+		json.NewDecoder(req.Body).Decode(&exec)
+		s.commands = append(s.commands, exec.Command)
+		if s.agentDown > 0 {
+			s.agentDown--
+			s.respond(w, "error", http.StatusBadRequest, nil)
+			return
+		}
+		s.async(w, map[string]interface{}{
+			"return": 0,
+			"output": map[string]string{"1": "/1.0/instances/" + path[2] + "/logs/exec.stdout"},
+		})
+	case req.Method == "GET" && len(path) == 5 && path[3] == "logs":
+		w.Write([]byte("output"))
+	case req.Method == "POST" && len(path) == 4 && path[3] == "snapshots":
+		s.async(w, nil)
+	case req.Method == "PUT" && len(path) == 3:
+		s.async(w, nil)
+	case req.Method == "DELETE" && len(path) == 5 && path[3] == "snapshots":
+		s.respond(w, "error", http.StatusNotFound, nil)
+	case req.Method == "DELETE" && len(path) == 3:
+		// Ephemeral containers are gone once stopped.
+		s.respond(w, "error", http.StatusNotFound, nil)
+	default:
+		s.respond(w, "error", http.StatusNotImplemented, nil)
+	}
+}
+
+func (s *LXDSuite) TestAllocateDiscard(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	system := &spread.System{Backend: "lxd", Name: "ubuntu-16.04", Image: "ubuntu-16.04"}
+	provider := spread.LXD(&spread.Project{}, backend, &spread.Options{Password: "secret"})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, "10.0.0.2")
+	c.Assert(server.String(), Equals, "lxd:ubuntu-16.04 (spread-1-ubuntu-16-04)")
+
+	c.Assert(s.created, DeepEquals, map[string]interface{}{
+		"name":      "spread-1-ubuntu-16-04",
+		"type":      "container",
+		"ephemeral": true,
+		"source": map[string]interface{}{
+			"type":     "image",
+			"mode":     "pull",
+			"server":   "https://cloud-images.ubuntu.com/releases",
+			"protocol": "simplestreams",
+			"alias":    "16.04",
+		},
+	})
+	// The network is waited for from within the instance.
+	c.Assert(s.commands, HasLen, 4)
+	c.Assert(s.commands[0][:2], DeepEquals, []string{"/bin/sh", "-c"})
+	c.Assert(s.commands[0][2], Matches, `(?s).*/proc/net/route.*`)
+	c.Assert(s.commands[2], DeepEquals, []string{"/bin/bash", "-c", "echo root:'secret' | chpasswd"})
+
+	s.requests = nil
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.requests, DeepEquals, []string{
+		"PUT /1.0/instances/spread-1-ubuntu-16-04/state",
+		"GET /1.0/operations/op7/wait",
+		"DELETE /1.0/instances/spread-1-ubuntu-16-04",
+	})
+}
+
+func (s *LXDSuite) TestAllocateKey(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	system := &spread.System{Backend: "lxd", Name: "ubuntu-16.04", Image: "ubuntu-16.04"}
+	options := &spread.Options{Password: "secret", PublicKey: "ecdsa-sha2-nistp256 AAAA"}
+	provider := spread.LXD(&spread.Project{}, backend, options)
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+
+	// Password logins are left alone.
+	c.Assert(s.commands, HasLen, 2)
+	c.Assert(s.commands[1][:2], DeepEquals, []string{"/bin/bash", "-c"})
+	c.Assert(s.commands[1][2], Matches, `.*echo 'ecdsa-sha2-nistp256 AAAA' >> /root/.ssh/authorized_keys.*`)
+	c.Assert(server.(spread.KeyServer).KeyAuthorized(), Equals, true)
+}
+
+func (s *LXDSuite) TestAllocateVM(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	system := &spread.System{
+		Backend:  "lxd",
+		Name:     "ubuntu-20.04",
+		Image:    "ubuntu:20.04",
+		VM:       true,
+		Profiles: []string{"default", "big"},
+		Config:   map[string]string{"security.nesting": "true"},
+		Devices:  map[string]map[string]string{"kvm": {"type": "unix-char", "path": "/dev/kvm"}},
+	}
+	provider := spread.LXD(&spread.Project{}, backend, &spread.Options{Reuse: true})
+
+	s.network["enp5s0"] = s.network["eth0"]
+	s.network["docker0"] = map[string]interface{}{
+		"type":      "broadcast",
+		"addresses": []map[string]string{{"family": "inet", "address": "172.17.0.1", "scope": "global"}},
+	}
+	delete(s.network, "eth0")
+
+	// Commands fail until the agent of the virtual machine is up.
+	s.agentDown = 1
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, "10.0.0.2")
+	c.Assert(s.commands, HasLen, 5)
+	c.Assert(s.commands[0], DeepEquals, s.commands[1])
+
+	c.Assert(s.created["type"], Equals, "virtual-machine")
+	c.Assert(s.created["ephemeral"], Equals, false)
+	c.Assert(s.created["profiles"], DeepEquals, []interface{}{"default", "big"})
+	c.Assert(s.created["config"], DeepEquals, map[string]interface{}{"security.nesting": "true"})
+	c.Assert(s.created["devices"], DeepEquals, map[string]interface{}{
+		"kvm": map[string]interface{}{"type": "unix-char", "path": "/dev/kvm"},
+	})
+}
+
+func (s *LXDSuite) TestAddressNIC(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	system := &spread.System{
+		Backend: "lxd",
+		Name:    "ubuntu-20.04",
+		Image:   "ubuntu:20.04",
+		Devices: map[string]map[string]string{"lan": {"type": "nic", "name": "lan0", "nictype": "macvlan", "parent": "enp3s0"}},
+	}
+	provider := spread.LXD(&spread.Project{}, backend, &spread.Options{})
+
+	s.network["lan0"] = map[string]interface{}{
+		"type":      "broadcast",
+		"addresses": []map[string]string{{"family": "inet", "address": "192.168.1.7", "scope": "global"}},
+	}
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, "192.168.1.7")
+}
+
+func (s *LXDSuite) TestSnapshot(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	system := &spread.System{Backend: "lxd", Name: "ubuntu-16.04", Image: "ubuntu-16.04"}
+	provider := spread.LXD(&spread.Project{}, backend, &spread.Options{})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	snapshotter, ok := server.(spread.Snapshotter)
+	c.Assert(ok, Equals, true)
+
+	s.requests = nil
+	c.Assert(snapshotter.Snapshot("spread-reset"), IsNil)
+	c.Assert(snapshotter.RestoreSnapshot("spread-reset"), IsNil)
+	c.Assert(s.requests, DeepEquals, []string{
+		"DELETE /1.0/instances/spread-1-ubuntu-16-04/snapshots/spread-reset",
+		"POST /1.0/instances/spread-1-ubuntu-16-04/snapshots",
+		"GET /1.0/operations/op7/wait",
+		"PUT /1.0/instances/spread-1-ubuntu-16-04",
+		"GET /1.0/operations/op8/wait",
+	})
+}
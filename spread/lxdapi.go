@@ -0,0 +1,445 @@
+package spread
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// lxdClient talks to an LXD daemon via its REST API, either over the
+// local unix socket or over HTTPS for remote hosts.
+type lxdClient struct {
+	http *http.Client
+	base string
+}
+
+type lxdResponse struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status_code"`
+	Operation  string          `json:"operation"`
+	ErrorCode  int             `json:"error_code"`
+	Error      string          `json:"error"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type lxdOperation struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Err        string          `json:"err"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+// lxdError is an error reported by the LXD daemon.
+type lxdError struct {
+	code int
+	msg  string
+}
+
+func (e *lxdError) Error() string {
+	return e.msg
+}
+
+func isLXDNotFound(err error) bool {
+	e, ok := err.(*lxdError)
+	return ok && e.code == http.StatusNotFound
+}
+
+// lxdConfig is the configuration of the lxc client tool, which
+// defines the known remotes.
+type lxdConfig struct {
+	DefaultRemote string `yaml:"default-remote"`
+	Remotes       map[string]lxdRemote
+}
+
+type lxdRemote struct {
+	Addr     string
+	Protocol string
+	Public   bool
+}
+
+// lxdDefaultRemotes are the image servers known to lxc out of the box.
+var lxdDefaultRemotes = map[string]lxdRemote{
+	"ubuntu":       {Addr: "https://cloud-images.ubuntu.com/releases", Protocol: "simplestreams", Public: true},
+	"ubuntu-daily": {Addr: "https://cloud-images.ubuntu.com/daily", Protocol: "simplestreams", Public: true},
+	"images":       {Addr: "https://images.linuxcontainers.org", Protocol: "simplestreams", Public: true},
+}
+
+// lxdConfigDir returns the configuration directory of the lxc client.
+func lxdConfigDir() string {
+	if dir := os.Getenv("LXD_CONF"); dir != "" {
+		return dir
+	}
+	snapDir := os.ExpandEnv("$HOME/snap/lxd/common/config")
+	if _, err := os.Stat(snapDir); err == nil {
+		return snapDir
+	}
+	return os.ExpandEnv("$HOME/.config/lxc")
+}
+
+func readLXDConfig() (*lxdConfig, error) {
+	config := &lxdConfig{}
+	data, err := ioutil.ReadFile(filepath.Join(lxdConfigDir(), "config.yml"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read lxc configuration: %v", err)
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal lxc configuration: %v", err)
+	}
+	return config, nil
+}
+
+// remote returns the details of the named remote, either from the
+// lxc configuration or from the ones lxc knows by default.
+func (config *lxdConfig) remote(name string) (lxdRemote, bool) {
+	if remote, ok := config.Remotes[name]; ok {
+		return remote, true
+	}
+	remote, ok := lxdDefaultRemotes[name]
+	return remote, ok
+}
+
+// lxdSocketPath returns the path of the unix socket of the local daemon.
+func lxdSocketPath() string {
+	if dir := os.Getenv("LXD_DIR"); dir != "" {
+		return filepath.Join(dir, "unix.socket")
+	}
+	const snapSocket = "/var/snap/lxd/common/lxd/unix.socket"
+	if _, err := os.Stat(snapSocket); err == nil {
+		return snapSocket
+	}
+	return "/var/lib/lxd/unix.socket"
+}
+
+// newLXDClient returns a client for the given remote, which may be empty
+// for the local daemon, the name of a remote known to lxc, or the URL
+// of a remote daemon.
+func newLXDClient(remote string) (*lxdClient, error) {
+	addr := remote
+	if remote == "" || remote == "local" {
+		addr = "unix://" + lxdSocketPath()
+	} else if !strings.Contains(remote, "://") {
+		config, err := readLXDConfig()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := config.remote(remote)
+		if !ok {
+			return nil, fmt.Errorf("cannot find lxd remote %q in lxc configuration", remote)
+		}
+		addr = r.Addr
+		if addr == "unix://" {
+			addr = "unix://" + lxdSocketPath()
+		}
+	}
+
+	if strings.HasPrefix(addr, "unix://") {
+		socket := strings.TrimPrefix(addr, "unix://")
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &lxdClient{http: &http.Client{Transport: transport}, base: "http://lxd"}, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid lxd remote address %q", addr)
+	}
+	tlsConfig, err := lxdTLSConfig(remote)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	return &lxdClient{http: &http.Client{Transport: transport}, base: strings.TrimRight(addr, "/")}, nil
+}
+
+// lxdTLSConfig returns the TLS configuration for talking to the named
+// remote with the lxc client certificate. Server certificates accepted
+// by lxc for the remote are pinned, as they're usually self-signed.
+func lxdTLSConfig(remote string) (*tls.Config, error) {
+	dir := lxdConfigDir()
+	config := &tls.Config{}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err == nil {
+		config.Certificates = []tls.Certificate{cert}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot load lxc client certificate: %v", err)
+	}
+	pinned, err := ioutil.ReadFile(filepath.Join(dir, "servercerts", remote+".crt"))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lxd server certificate: %v", err)
+	}
+	block, _ := pem.Decode(pinned)
+	if block == nil {
+		return nil, fmt.Errorf("cannot parse lxd server certificate for remote %q", remote)
+	}
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+			return fmt.Errorf("lxd server certificate does not match the one known for remote %q", remote)
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// do performs a request against the API and returns the response after
+// unmarshalling its metadata into result, if not nil.
+func (c *lxdClient) do(method, path string, body interface{}, result interface{}) (*lxdResponse, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, fmt.Errorf("internal error: cannot marshal lxd request: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, c.base+path, &reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("internal error: cannot create lxd request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot talk to lxd: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var lresp lxdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lresp); err != nil {
+		return nil, fmt.Errorf("cannot decode lxd response to %s %s: %v", method, path, err)
+	}
+	if lresp.Type == "error" {
+		return nil, &lxdError{lresp.ErrorCode, lresp.Error}
+	}
+	if result != nil {
+		if err := json.Unmarshal(lresp.Metadata, result); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal lxd response to %s %s: %v", method, path, err)
+		}
+	}
+	return &lresp, nil
+}
+
+// raw returns the unprocessed body of the given API path, as used for
+// files such as the recorded output of commands.
+func (c *lxdClient) raw(path string) ([]byte, error) {
+	resp, err := c.http.Get(c.base + path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot talk to lxd: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lxd response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot get %s from lxd: %s", path, resp.Status)
+	}
+	return data, nil
+}
+
+// async performs a request that starts an operation, and waits for
+// the operation to finish.
+func (c *lxdClient) async(method, path string, body interface{}) (*lxdOperation, error) {
+	resp, err := c.do(method, path, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != "async" || resp.Operation == "" {
+		return nil, fmt.Errorf("expected lxd operation in response to %s %s, got %q response", method, path, resp.Type)
+	}
+	var op lxdOperation
+	if _, err := c.do("GET", resp.Operation+"/wait", nil, &op); err != nil {
+		return nil, err
+	}
+	if op.StatusCode != http.StatusOK {
+		return &op, &lxdError{op.StatusCode, op.Err}
+	}
+	return &op, nil
+}
+
+type lxdImageSource struct {
+	Type     string `json:"type"`
+	Mode     string `json:"mode,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Alias    string `json:"alias"`
+}
+
+type lxdInstancesPost struct {
+	Name      string                       `json:"name"`
+	Type      string                       `json:"type,omitempty"`
+	Ephemeral bool                         `json:"ephemeral"`
+	Profiles  []string                     `json:"profiles,omitempty"`
+	Config    map[string]string            `json:"config,omitempty"`
+	Devices   map[string]map[string]string `json:"devices,omitempty"`
+	Source    lxdImageSource               `json:"source"`
+}
+
+type lxdStatePut struct {
+	Action  string `json:"action"`
+	Timeout int    `json:"timeout"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+type lxdSnapshotPost struct {
+	Name     string `json:"name"`
+	Stateful bool   `json:"stateful"`
+}
+
+type lxdInstancePut struct {
+	Restore string `json:"restore"`
+}
+
+type lxdExecPost struct {
+	Command          []string `json:"command"`
+	WaitForWebsocket bool     `json:"wait-for-websocket"`
+	Interactive      bool     `json:"interactive"`
+	RecordOutput     bool     `json:"record-output"`
+}
+
+type lxdStateJSON struct {
+	Status  string                   `json:"status"`
+	Network map[string]lxdDeviceJSON `json:"network"`
+}
+
+type lxdDeviceJSON struct {
+	Type      string           `json:"type"`
+	State     string           `json:"state"`
+	Addresses []lxdAddressJSON `json:"addresses"`
+}
+
+type lxdAddressJSON struct {
+	Family  string `json:"family"`
+	Address string `json:"address"`
+	Scope   string `json:"scope"`
+}
+
+// imageSource returns the source for creating an instance out of image,
+// which may be prefixed by the name of the remote holding it.
+func (c *lxdClient) imageSource(image string) (lxdImageSource, error) {
+	source := lxdImageSource{Type: "image", Alias: image}
+	i := strings.Index(image, ":")
+	if i < 0 {
+		return source, nil
+	}
+	if image[:i] == "local" {
+		source.Alias = image[i+1:]
+		return source, nil
+	}
+	config, err := readLXDConfig()
+	if err != nil {
+		return source, err
+	}
+	remote, ok := config.remote(image[:i])
+	if !ok {
+		return source, fmt.Errorf("cannot find lxd image remote %q in lxc configuration", image[:i])
+	}
+	source.Mode = "pull"
+	source.Server = remote.Addr
+	source.Protocol = remote.Protocol
+	if source.Protocol == "" {
+		source.Protocol = "lxd"
+	}
+	source.Alias = image[i+1:]
+	return source, nil
+}
+
+func (c *lxdClient) create(post *lxdInstancesPost) error {
+	_, err := c.async("POST", "/1.0/instances", post)
+	return err
+}
+
+func (c *lxdClient) setState(name string, state *lxdStatePut) error {
+	_, err := c.async("PUT", "/1.0/instances/"+url.PathEscape(name)+"/state", state)
+	return err
+}
+
+func (c *lxdClient) state(name string) (*lxdStateJSON, error) {
+	var state lxdStateJSON
+	_, err := c.do("GET", "/1.0/instances/"+url.PathEscape(name)+"/state", nil, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *lxdClient) delete(name string) error {
+	_, err := c.async("DELETE", "/1.0/instances/"+url.PathEscape(name), nil)
+	return err
+}
+
+// snapshot saves a snapshot of the named instance, replacing any
+// previous snapshot with the same name.
+func (c *lxdClient) snapshot(name, snapshot string) error {
+	path := "/1.0/instances/" + url.PathEscape(name) + "/snapshots"
+	_, err := c.async("DELETE", path+"/"+url.PathEscape(snapshot), nil)
+	if err != nil && !isLXDNotFound(err) {
+		return err
+	}
+	_, err = c.async("POST", path, &lxdSnapshotPost{Name: snapshot})
+	return err
+}
+
+// restore brings the named instance back to the state of snapshot.
+// Running instances are restarted by the daemon in the process.
+func (c *lxdClient) restore(name, snapshot string) error {
+	_, err := c.async("PUT", "/1.0/instances/"+url.PathEscape(name), &lxdInstancePut{Restore: snapshot})
+	return err
+}
+
+// exec runs command in the named instance and returns its combined
+// output, and an error if it fails to run or returns a non-zero status.
+func (c *lxdClient) exec(name string, command []string) ([]byte, error) {
+	op, err := c.async("POST", "/1.0/instances/"+url.PathEscape(name)+"/exec", &lxdExecPost{
+		Command:      command,
+		RecordOutput: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Return int               `json:"return"`
+		Output map[string]string `json:"output"`
+	}
+	if err := json.Unmarshal(op.Metadata, &result); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal lxd exec result: %v", err)
+	}
+	var output []byte
+	for _, fd := range []string{"1", "2"} {
+		if path, ok := result.Output[fd]; ok {
+			data, err := c.raw(path)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, data...)
+		}
+	}
+	if result.Return != 0 {
+		return output, fmt.Errorf("exit status %d", result.Return)
+	}
+	return output, nil
+}
+
+// lxdStateTimeout is how many seconds LXD may take to change the
+// state of an instance.
+const lxdStateTimeout = 30
@@ -0,0 +1,216 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterProvider("nspawn", Nspawn)
+	RegisterValidator("nspawn", validateNspawn)
+}
+
+func validateNspawn(p *Project, b *Backend) error {
+	for _, sysname := range b.systemNames() {
+		image := b.Systems[sysname].Image
+		if !filepath.IsAbs(image) && strings.Contains(image, "/") {
+			return fmt.Errorf("%s has system %q with image %q that is neither a name nor an absolute path", b, sysname, image)
+		}
+	}
+	return nil
+}
+
+func Nspawn(p *Project, b *Backend, o *Options) Provider {
+	return &nspawnProvider{p, b, o}
+}
+
+type nspawnProvider struct {
+	project *Project
+	backend *Backend
+	options *Options
+}
+
+type nspawnServer struct {
+	p *nspawnProvider
+	d nspawnServerData
+
+	system  *System
+	address string
+}
+
+type nspawnServerData struct {
+	Name string
+}
+
+func (s *nspawnServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.system, s.d.Name)
+}
+
+func (s *nspawnServer) Provider() Provider {
+	return s.p
+}
+
+func (s *nspawnServer) Address() string {
+	return s.address
+}
+
+func (s *nspawnServer) System() *System {
+	return s.system
+}
+
+func (s *nspawnServer) ReuseData() interface{} {
+	return &s.d
+}
+
+func (s *nspawnServer) KeyAuthorized() bool {
+	return s.p.options.PublicKey != ""
+}
+
+func (s *nspawnServer) Discard() error {
+	// Ephemeral machines are removed once terminated.
+	output, err := exec.Command("machinectl", "terminate", s.d.Name).CombinedOutput()
+	if err != nil && !strings.Contains(string(output), "No machine") {
+		return fmt.Errorf("cannot discard nspawn machine: %v", outputErr(output, err))
+	}
+	return nil
+}
+
+func (p *nspawnProvider) Backend() *Backend {
+	return p.backend
+}
+
+func (p *nspawnProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error) {
+	s := &nspawnServer{
+		p:       p,
+		system:  system,
+		address: rsystem.Address,
+	}
+	err := rsystem.UnmarshalData(&s.d)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal nspawn reuse data: %v", err)
+	}
+	return s, nil
+}
+
+// imageArgs returns the systemd-nspawn arguments for booting system,
+// which is either a root filesystem directory named after its image
+// or a raw disk image with the same name plus a .raw suffix, both
+// under ~/.spread/nspawn unless the image is an absolute path.
+func (p *nspawnProvider) imageArgs(system *System) ([]string, error) {
+	path := system.Image
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(os.ExpandEnv("$HOME/.spread/nspawn"), path)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return []string{"--directory", path}, nil
+		}
+		return []string{"--image", path}, nil
+	}
+	if info, err := os.Stat(path + ".raw"); err == nil && !info.IsDir() {
+		return []string{"--image", path + ".raw"}, nil
+	}
+	return nil, fmt.Errorf("cannot find nspawn root filesystem or image at %s", path)
+}
+
+func (p *nspawnProvider) Allocate(system *System) (Server, error) {
+	image, err := p.imageArgs(system)
+	if err != nil {
+		return nil, &FatalError{err}
+	}
+	name, err := lxdName(system)
+	if err != nil {
+		return nil, err
+	}
+
+	// The machine runs under its own transient unit so that it
+	// outlives spread when reused. It is ephemeral either way, so
+	// the image itself is never modified.
+	args := []string{"--unit", name, "--collect", "--quiet", "--",
+		"systemd-nspawn", "--boot", "--ephemeral", "--quiet", "--keep-unit",
+		"--network-veth", "--machine", name}
+	args = append(args, image...)
+	output, err := exec.Command("systemd-run", args...).CombinedOutput()
+	if err != nil {
+		return nil, &FatalError{fmt.Errorf("cannot start nspawn machine: %v", outputErr(output, err))}
+	}
+
+	s := &nspawnServer{
+		p: p,
+		d: nspawnServerData{
+			Name: name,
+		},
+		system: system,
+	}
+
+	// Commands can only run in the machine once its init is up, and
+	// the address only shows up once its network is configured.
+	printf("Waiting for nspawn machine %s to have an address...", name)
+	timeout := time.After(1 * time.Minute)
+	retry := time.NewTicker(1 * time.Second)
+	defer retry.Stop()
+	for {
+		addr, err := p.address(name)
+		if err == nil {
+			s.address = addr
+			break
+		}
+		select {
+		case <-retry.C:
+		case <-timeout:
+			s.Discard()
+			return nil, err
+		}
+	}
+
+	err = p.tuneSSH(name)
+	if err != nil {
+		s.Discard()
+		return nil, err
+	}
+
+	printf("Waiting for %s to make SSH available...", system)
+	if err := waitPortUp(system, s.address); err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("cannot connect to %s: %s", s, err)
+	}
+
+	printf("Allocated %s.", s)
+	return s, nil
+}
+
+// exec runs the command args inside the named machine.
+func (p *nspawnProvider) exec(name string, args ...string) ([]byte, error) {
+	args = append([]string{"--machine", name, "--pipe", "--wait", "--quiet", "--"}, args...)
+	return exec.Command("systemd-run", args...).CombinedOutput()
+}
+
+func (p *nspawnProvider) address(name string) (string, error) {
+	output, err := p.exec(name, "ip", "-4", "-o", "addr", "show", "scope", "global")
+	if err != nil {
+		return "", fmt.Errorf("cannot get address of nspawn machine %s: %v", name, outputErr(output, err))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet" {
+				return strings.Split(fields[i+1], "/")[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("nspawn machine %s has no address available", name)
+}
+
+func (p *nspawnProvider) tuneSSH(name string) error {
+	err := tuneSSH(func(args []string) ([]byte, error) {
+		return p.exec(name, args...)
+	}, p.options.Password, p.options.PublicKey)
+	if err != nil {
+		return fmt.Errorf("cannot prepare sshd in nspawn machine %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package spread_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type NspawnSuite struct {
+	home     string
+	images   string
+	listener net.Listener
+	exec     *fakeExec
+}
+
+var _ = Suite(&NspawnSuite{})
+
+func (s *NspawnSuite) SetUpTest(c *C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	s.images = os.ExpandEnv("$HOME/.spread/nspawn")
+	c.Assert(os.MkdirAll(filepath.Join(s.images, "ubuntu-20.04"), 0755), IsNil)
+
+	// Stands for the SSH port of the machine, which is reported
+	// along with the address for the sake of testing.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+
+	s.exec = newFakeExec(c, map[string]string{
+		"systemd-run": fmt.Sprintf(`
+case "$*" in
+*" -- ip "*) echo "2: host0    inet %s/28 brd 10.0.0.15 scope global host0" ;;
+esac
+`, l.Addr()),
+		"machinectl": `
+if [ -f "$(dirname "$0")/gone" ]; then
+	echo "No machine '$2' known" >&2
+	exit 1
+fi
+`,
+	})
+}
+
+func (s *NspawnSuite) TearDownTest(c *C) {
+	s.exec.restore()
+	s.listener.Close()
+	os.Setenv("HOME", s.home)
+}
+
+func (s *NspawnSuite) provider(options *spread.Options) spread.Provider {
+	backend := &spread.Backend{Name: "nspawn", Type: "nspawn"}
+	return spread.Nspawn(&spread.Project{}, backend, options)
+}
+
+func (s *NspawnSuite) TestAllocateDiscard(c *C) {
+	system := &spread.System{Backend: "nspawn", Name: "ubuntu-20.04", Image: "ubuntu-20.04"}
+	provider := s.provider(&spread.Options{Password: "secret"})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, s.listener.Addr().String())
+	c.Assert(server.String(), Equals, "nspawn:ubuntu-20.04 (spread-1-ubuntu-20-04)")
+
+	run := []string{"systemd-run", "--machine", "spread-1-ubuntu-20-04", "--pipe", "--wait", "--quiet", "--"}
+	c.Assert(s.exec.calls(c), DeepEquals, [][]string{
+		{"systemd-run", "--unit", "spread-1-ubuntu-20-04", "--collect", "--quiet", "--",
+			"systemd-nspawn", "--boot", "--ephemeral", "--quiet", "--keep-unit",
+			"--network-veth", "--machine", "spread-1-ubuntu-20-04",
+			"--directory", filepath.Join(s.images, "ubuntu-20.04")},
+		append(run, "ip", "-4", "-o", "addr", "show", "scope", "global"),
+		append(run, "sed", "-i", `s/\(PermitRootLogin\|PasswordAuthentication\)\>.*/\1 yes/`, "/etc/ssh/sshd_config"),
+		append(run, "/bin/bash", "-c", "echo root:'secret' | chpasswd"),
+		append(run, "killall", "-HUP", "sshd"),
+	})
+
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.exec.calls(c), DeepEquals, [][]string{
+		{"machinectl", "terminate", "spread-1-ubuntu-20-04"},
+	})
+
+	// Machines that are gone already are fine.
+	c.Assert(ioutil.WriteFile(filepath.Join(s.exec.dir, "gone"), nil, 0644), IsNil)
+	c.Assert(server.Discard(), IsNil)
+}
+
+func (s *NspawnSuite) TestAllocateKey(c *C) {
+	system := &spread.System{Backend: "nspawn", Name: "ubuntu-20.04", Image: "ubuntu-20.04"}
+	provider := s.provider(&spread.Options{Password: "secret", PublicKey: "ecdsa-sha2-nistp256 AAAA"})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.(spread.KeyServer).KeyAuthorized(), Equals, true)
+
+	// Password logins are left alone.
+	calls := s.exec.calls(c)
+	c.Assert(calls, HasLen, 3)
+	c.Assert(calls[2][:9], DeepEquals, []string{"systemd-run", "--machine", "spread-1-ubuntu-20-04", "--pipe", "--wait", "--quiet", "--", "/bin/bash", "-c"})
+	c.Assert(calls[2][9], Matches, `.*echo 'ecdsa-sha2-nistp256 AAAA' >> /root/.ssh/authorized_keys.*`)
+}
+
+func (s *NspawnSuite) TestImages(c *C) {
+	provider := s.provider(&spread.Options{})
+	raw := filepath.Join(s.images, "fedora-38.raw")
+	c.Assert(ioutil.WriteFile(raw, nil, 0644), IsNil)
+	abs := filepath.Join(c.MkDir(), "rootfs")
+	c.Assert(os.Mkdir(abs, 0755), IsNil)
+
+	tests := []struct {
+		image string
+		args  []string
+	}{
+		{"fedora-38", []string{"--image", raw}},
+		{raw, []string{"--image", raw}},
+		{abs, []string{"--directory", abs}},
+	}
+	for _, test := range tests {
+		system := &spread.System{Backend: "nspawn", Name: "some-system", Image: test.image}
+		server, err := provider.Allocate(system)
+		c.Assert(err, IsNil)
+		calls := s.exec.calls(c)
+		c.Assert(calls[0][len(calls[0])-2:], DeepEquals, test.args, Commentf("Image: %s", test.image))
+		c.Assert(server.Discard(), IsNil)
+		s.exec.calls(c)
+	}
+
+	system := &spread.System{Backend: "nspawn", Name: "some-system", Image: "missing"}
+	_, err := provider.Allocate(system)
+	c.Assert(err, ErrorMatches, `cannot find nspawn root filesystem or image at .*/\.spread/nspawn/missing`)
+	c.Assert(s.exec.calls(c), HasLen, 0)
+}
@@ -0,0 +1,306 @@
+package spread
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("plugin", Plugin)
+	RegisterValidator("plugin", validatePlugin)
+	RegisterFields("plugin", "plugin")
+}
+
+// pluginVersion is the version of the protocol spread speaks with
+// plugin executables. Plugins must answer with the same version.
+const pluginVersion = 1
+
+func Plugin(p *Project, b *Backend, o *Options) Provider {
+	return &pluginProvider{p, b, o}
+}
+
+type pluginProvider struct {
+	project *Project
+	backend *Backend
+	options *Options
+}
+
+type pluginServer struct {
+	p *pluginProvider
+	d pluginServerData
+
+	system  *System
+	address string
+}
+
+// pluginServerData holds the reuse data reported by the plugin as
+// a JSON document, so it goes back to the plugin exactly as it was
+// sent in the first place.
+type pluginServerData struct {
+	Data string `yaml:",omitempty"`
+}
+
+func (s *pluginServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.system, s.address)
+}
+
+func (s *pluginServer) Provider() Provider {
+	return s.p
+}
+
+func (s *pluginServer) Address() string {
+	return s.address
+}
+
+func (s *pluginServer) System() *System {
+	return s.system
+}
+
+func (s *pluginServer) ReuseData() interface{} {
+	return &s.d
+}
+
+func (s *pluginServer) Discard() error {
+	_, err := s.p.call("discard", s.system, s.json())
+	if err != nil {
+		return fmt.Errorf("cannot discard %s: %v", s, err)
+	}
+	return nil
+}
+
+func (s *pluginServer) json() *pluginServerJSON {
+	sjson := &pluginServerJSON{
+		System:  s.system.Name,
+		Address: s.address,
+	}
+	if s.d.Data != "" {
+		sjson.Data = json.RawMessage(s.d.Data)
+	}
+	return sjson
+}
+
+func (p *pluginProvider) Backend() *Backend {
+	return p.backend
+}
+
+func validatePlugin(p *Project, b *Backend) error {
+	if strings.TrimSpace(b.Plugin) == "" {
+		return fmt.Errorf("%s requires a plugin field", b)
+	}
+	return nil
+}
+
+func (p *pluginProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error) {
+	s := &pluginServer{
+		p:       p,
+		system:  system,
+		address: rsystem.Address,
+	}
+	// The server is returned along with errors so that it gets discarded.
+	err := rsystem.UnmarshalData(&s.d)
+	if err != nil {
+		return s, fmt.Errorf("cannot unmarshal plugin reuse data: %v", err)
+	}
+	resp, err := p.call("status", system, s.json())
+	if err != nil {
+		return s, err
+	}
+	if resp.Alive == nil || !*resp.Alive {
+		return s, fmt.Errorf("plugin reports %s is not alive", s)
+	}
+	resp, err = p.call("reuse", system, s.json())
+	if err != nil {
+		return s, err
+	}
+	if resp.Server != nil {
+		if err := s.update(resp.Server); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (p *pluginProvider) Allocate(system *System) (Server, error) {
+	resp, err := p.call("allocate", system, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Server == nil {
+		return nil, fmt.Errorf("%s plugin did not report allocated server", p.backend)
+	}
+
+	s := &pluginServer{
+		p:      p,
+		system: system,
+	}
+	if err := s.update(resp.Server); err != nil {
+		return nil, err
+	}
+
+	printf("Waiting for %s to make SSH available at %s...", system, s.address)
+	if err := waitPortUp(system, s.address); err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("cannot connect to %s at %s: %s", s, s.Address(), err)
+	}
+	printf("Allocated %s.", s)
+	return s, nil
+}
+
+func (s *pluginServer) update(sjson *pluginServerJSON) error {
+	if sjson.Address == "" || strings.Contains(sjson.Address, " ") {
+		return fmt.Errorf("%s plugin must report the SSH address of %s, got: %q", s.p.backend, s.system, sjson.Address)
+	}
+	s.address = sjson.Address
+	s.d.Data = string(sjson.Data)
+	return nil
+}
+
+// listServers returns the servers the plugin knows about, so the runner
+// may report those it is not tracking for reuse.
+func (p *pluginProvider) listServers() ([]listedServer, error) {
+	resp, err := p.call("list", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var servers []listedServer
+	for _, sjson := range resp.Servers {
+		servers = append(servers, listedServer{System: sjson.System, Address: sjson.Address})
+	}
+	return servers, nil
+}
+
+type pluginRequest struct {
+	Version   int               `json:"version"`
+	Operation string            `json:"operation"`
+	Project   string            `json:"project"`
+	Backend   string            `json:"backend"`
+	System    *pluginSystemJSON `json:"system,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	PublicKey string            `json:"key,omitempty"`
+	Reuse     bool              `json:"reuse,omitempty"`
+	Server    *pluginServerJSON `json:"server,omitempty"`
+}
+
+type pluginSystemJSON struct {
+	Name     string `json:"name"`
+	Image    string `json:"image"`
+	Kernel   string `json:"kernel,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type pluginServerJSON struct {
+	System  string          `json:"system,omitempty"`
+	Address string          `json:"address"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type pluginResponse struct {
+	Version  int                 `json:"version"`
+	Progress string              `json:"progress,omitempty"`
+	Error    string              `json:"error,omitempty"`
+	Fatal    bool                `json:"fatal,omitempty"`
+	Server   *pluginServerJSON   `json:"server,omitempty"`
+	Alive    *bool               `json:"alive,omitempty"`
+	Servers  []*pluginServerJSON `json:"servers,omitempty"`
+}
+
+// call runs the plugin executable for the given operation, sending the
+// request as a JSON document via stdin. The plugin answers via stdout
+// with a sequence of JSON documents, where those with a progress field
+// are logged as they arrive and the last one holds the result.
+func (p *pluginProvider) call(operation string, system *System, server *pluginServerJSON) (*pluginResponse, error) {
+	req := &pluginRequest{
+		Version:   pluginVersion,
+		Operation: operation,
+		Project:   p.project.Name,
+		Backend:   p.backend.Name,
+		Reuse:     p.options.Reuse,
+		Server:    server,
+	}
+	if system != nil {
+		req.System = &pluginSystemJSON{
+			Name:     system.Name,
+			Image:    system.Image,
+			Kernel:   system.Kernel,
+			Username: system.Username,
+			Password: system.Password,
+		}
+		if system.Password == "" && operation == "allocate" {
+			req.Password = p.options.Password
+		}
+		if operation == "allocate" {
+			req.PublicKey = p.options.PublicKey
+		}
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("internal error: cannot marshal plugin request: %v", err)
+	}
+
+	path := p.backend.Plugin
+	if !filepath.IsAbs(path) && strings.Contains(path, "/") {
+		path = filepath.Join(p.project.Path, path)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, operation)
+	cmd.Dir = p.project.Path
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot run %s plugin: %v", p.backend, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, &FatalError{fmt.Errorf("cannot run %s plugin: %v", p.backend, err)}
+	}
+
+	var resp *pluginResponse
+	decoder := json.NewDecoder(stdout)
+	for {
+		var msg pluginResponse
+		err = decoder.Decode(&msg)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			io.Copy(ioutil.Discard, stdout)
+			break
+		}
+		if msg.Progress != "" {
+			printf("%s: %s", p.backend, msg.Progress)
+			continue
+		}
+		resp = &msg
+	}
+	werr := cmd.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s plugin output: %v", p.backend, err)
+	}
+	if werr != nil {
+		return nil, fmt.Errorf("%s plugin failed: %v", p.backend, outputErr(stderr.Bytes(), werr))
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("%s plugin returned no result for %s operation", p.backend, operation)
+	}
+
+	debugf("Plugin %s result for %s operation: %# v", p.backend, operation, resp)
+
+	if resp.Version != pluginVersion {
+		return nil, &FatalError{fmt.Errorf("%s plugin speaks protocol version %d, expected %d", p.backend, resp.Version, pluginVersion)}
+	}
+	if resp.Fatal {
+		return nil, &FatalError{fmt.Errorf("%s", resp.Error)}
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,172 @@
+package spread_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type PluginSuite struct {
+	dir      string
+	listener net.Listener
+	logger   *log.Logger
+	output   bytes.Buffer
+}
+
+var _ = Suite(&PluginSuite{})
+
+// pluginScript answers every operation with a canned response, after
+// saving the request it got into a file named after the operation.
+const pluginScript = `#!/bin/sh
+cat > "$(dirname "$0")/$1.json"
+case "$1" in
+allocate)
+	echo '{"progress": "Booting..."}'
+	echo '{"version": 1, "server": {"address": "%s", "data": {"id": "vm-1"}}}'
+	;;
+status)
+	echo '{"version": 1, "alive": true}'
+	;;
+list)
+	echo '{"version": 1, "servers": [{"system": "ubuntu-14.04", "address": "10.0.0.2:22"}, {"system": "ubuntu-16.04", "address": "10.0.0.3:22"}]}'
+	;;
+*)
+	echo '{"version": 1}'
+	;;
+esac
+`
+
+func (s *PluginSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+
+	// Stands for the SSH port of the allocated server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+
+	s.write(c, "plugin", fmt.Sprintf(pluginScript, l.Addr()), 0755)
+	s.write(c, "spread.yaml", `
+project: plugin-test
+path: /plugin-test
+backends:
+    plugin:
+        plugin: ./plugin
+        systems:
+            - ubuntu-16.04:
+                password: secret
+suites:
+    tests/:
+        summary: Plugin tests
+`, 0644)
+	s.write(c, "tests/task/task.yaml", "summary: Task\nexecute: true\n", 0644)
+
+	s.output.Reset()
+	s.logger = spread.Logger
+	spread.Logger = log.New(&s.output, "", 0)
+}
+
+func (s *PluginSuite) TearDownTest(c *C) {
+	spread.Logger = s.logger
+	s.listener.Close()
+}
+
+func (s *PluginSuite) write(c *C, name, content string, mode os.FileMode) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), mode), IsNil)
+}
+
+func (s *PluginSuite) request(c *C, operation string) map[string]interface{} {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, operation+".json"))
+	c.Assert(err, IsNil)
+	var req map[string]interface{}
+	c.Assert(json.Unmarshal(data, &req), IsNil)
+	return req
+}
+
+func (s *PluginSuite) TestAllocateDiscard(c *C) {
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+	backend := project.Backends["plugin"]
+	system := backend.Systems["ubuntu-16.04"]
+	provider := spread.Plugin(project, backend, &spread.Options{PublicKey: "ecdsa-sha2-nistp256 AAAA"})
+
+	server, err := provider.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, s.listener.Addr().String())
+	c.Assert(s.output.String(), Matches, `(?s).*backend "plugin": Booting\.\.\..*`)
+
+	c.Assert(s.request(c, "allocate"), DeepEquals, map[string]interface{}{
+		"version":   1.0,
+		"operation": "allocate",
+		"project":   "plugin-test",
+		"backend":   "plugin",
+		"key":       "ecdsa-sha2-nistp256 AAAA",
+		"system": map[string]interface{}{
+			"name":     "ubuntu-16.04",
+			"image":    "ubuntu-16.04",
+			"password": "secret",
+		},
+	})
+
+	// The data reported by the plugin goes back to it as it was.
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.request(c, "discard"), DeepEquals, map[string]interface{}{
+		"version":   1.0,
+		"operation": "discard",
+		"project":   "plugin-test",
+		"backend":   "plugin",
+		"system": map[string]interface{}{
+			"name":     "ubuntu-16.04",
+			"image":    "ubuntu-16.04",
+			"password": "secret",
+		},
+		"server": map[string]interface{}{
+			"system":  "ubuntu-16.04",
+			"address": s.listener.Addr().String(),
+			"data":    map[string]interface{}{"id": "vm-1"},
+		},
+	})
+}
+
+func (s *PluginSuite) TestDiscardList(c *C) {
+	// One server is reused by the project, and another one is tracked
+	// for a system that is no longer part of it.
+	s.write(c, ".spread-reuse.yaml", `
+backends:
+    plugin:
+        systems:
+            - ubuntu-16.04:
+                address: 10.0.0.1:22
+                data:
+                    data: '{"id": "vm-1"}'
+            - ubuntu-14.04:
+                address: 10.0.0.2:22
+`, 0644)
+
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+	runner, err := spread.Start(project, &spread.Options{Discard: true, Reuse: true})
+	c.Assert(err, IsNil)
+	c.Assert(runner.Wait(), IsNil)
+
+	c.Assert(s.request(c, "discard")["server"], DeepEquals, map[string]interface{}{
+		"system":  "ubuntu-16.04",
+		"address": "10.0.0.1:22",
+		"data":    map[string]interface{}{"id": "vm-1"},
+	})
+	c.Assert(s.request(c, "list")["operation"], Equals, "list")
+
+	// Only the server unknown to spread is reported.
+	c.Assert(s.output.String(), Matches, `(?s).*Server plugin:ubuntu-16.04 at 10.0.0.3:22 is not tracked.*`)
+	c.Assert(s.output.String(), Not(Matches), `(?s).*10.0.0.2:22 is not tracked.*`)
+}
@@ -0,0 +1,298 @@
+package spread
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func init() {
+	RegisterProvider("pool", Pool)
+	RegisterValidator("pool", validatePool)
+	RegisterFields("pool", "hosts")
+}
+
+func Pool(p *Project, b *Backend, o *Options) Provider {
+	return &poolProvider{
+		project: p,
+		backend: b,
+		options: o,
+
+		locks: make(map[string]*os.File),
+	}
+}
+
+type poolProvider struct {
+	project *Project
+	backend *Backend
+	options *Options
+
+	mu    sync.Mutex
+	locks map[string]*os.File
+}
+
+// PoolHost is a machine that is always up and may be used by
+// pool backends, one worker at a time.
+type PoolHost struct {
+	Address  string
+	Username string
+	Password string
+}
+
+func (h *PoolHost) UnmarshalYAML(u func(interface{}) error) error {
+	if err := u(&h.Address); err == nil {
+		return nil
+	}
+	type norecurse PoolHost
+	return u((*norecurse)(h))
+}
+
+type poolServer struct {
+	p *poolProvider
+
+	system  *System
+	address string
+}
+
+func (s *poolServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.system, s.address)
+}
+
+func (s *poolServer) Provider() Provider {
+	return s.p
+}
+
+func (s *poolServer) Address() string {
+	return s.address
+}
+
+func (s *poolServer) System() *System {
+	return s.system
+}
+
+func (s *poolServer) ReuseData() interface{} {
+	return nil
+}
+
+// Discard releases the host back into the pool, and forgets it was kept
+// for reuse. The host itself is left alone for the next user.
+func (s *poolServer) Discard() error {
+	s.p.unlock(s.address)
+	return nil
+}
+
+func (p *poolProvider) Backend() *Backend {
+	return p.backend
+}
+
+func validatePool(p *Project, b *Backend) error {
+	for _, sysname := range b.systemNames() {
+		system := b.Systems[sysname]
+		if len(system.Hosts) == 0 {
+			return fmt.Errorf("%s requires hosts for system %q", b, sysname)
+		}
+		for _, host := range system.Hosts {
+			if host.Address == "" || strings.Contains(host.Address, " ") {
+				return fmt.Errorf("%s has invalid host address for system %q: %q", b, sysname, host.Address)
+			}
+		}
+		// Every host may run a worker by default.
+		if system.Workers == 0 {
+			system.Workers = len(system.Hosts)
+		}
+	}
+	return nil
+}
+
+func (p *poolProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, error) {
+	s := &poolServer{
+		p:       p,
+		system:  system,
+		address: rsystem.Address,
+	}
+	// The server is returned along with errors so that it gets discarded.
+	host := p.host(system, rsystem.Address)
+	if host == nil {
+		return s, fmt.Errorf("%s is not in the %s pool anymore", rsystem.Address, system)
+	}
+	if err := p.lock(host.Address); err != nil {
+		return s, err
+	}
+	s.system = p.hostSystem(system, host)
+	return s, nil
+}
+
+func (p *poolProvider) Allocate(system *System) (Server, error) {
+	// Iterate out of order to reduce conflicts.
+	for _, i := range rnd.Perm(len(system.Hosts)) {
+		host := system.Hosts[i]
+		if err := p.lock(host.Address); err == errPoolHostBusy {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		s := &poolServer{
+			p:       p,
+			system:  p.hostSystem(system, host),
+			address: host.Address,
+		}
+		printf("Waiting for %s to make SSH available at %s...", system, host.Address)
+		if err := waitPortUp(system, host.Address); err != nil {
+			s.Discard()
+			return nil, fmt.Errorf("cannot connect to %s: %s", s, err)
+		}
+		printf("Allocated %s.", s)
+		return s, nil
+	}
+	return nil, fmt.Errorf("no free hosts in the %s pool", system)
+}
+
+func (p *poolProvider) host(system *System, address string) *PoolHost {
+	for _, host := range system.Hosts {
+		if host.Address == address {
+			return host
+		}
+	}
+	return nil
+}
+
+// hostSystem returns a copy of system with the credentials for host,
+// so they are used when connecting to it and recorded for reuse.
+func (p *poolProvider) hostSystem(system *System, host *PoolHost) *System {
+	hsystem := *system
+	if host.Username != "" {
+		hsystem.Username = host.Username
+		hsystem.Password = host.Password
+	} else if host.Password != "" {
+		hsystem.Password = host.Password
+	}
+	return &hsystem
+}
+
+var errPoolHostBusy = fmt.Errorf("pool host is busy")
+
+// poolLockDir returns the directory holding the pool lock files. It is
+// shared by all users of the local system, as hosts are usually too.
+func poolLockDir() string {
+	return filepath.Join(os.TempDir(), "spread-pool")
+}
+
+// lock obtains the lock on address that is shared by all spread
+// processes in the local system, so a host is only used by one worker
+// at a time. It returns errPoolHostBusy if the lock is held elsewhere,
+// or if the host is being kept for reuse by another project.
+//
+// Locks are released when the process terminates, so hosts kept for
+// reuse are recorded in the lock file with the project keeping them.
+func (p *poolProvider) lock(address string) error {
+	dir := poolLockDir()
+	if err := os.Mkdir(dir, 0777|os.ModeSticky); err == nil {
+		// Mode is subject to umask on creation.
+		if err := os.Chmod(dir, 0777|os.ModeSticky); err != nil {
+			return fmt.Errorf("cannot change mode of %s: %v", dir, err)
+		}
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("cannot create %s: %v", dir, err)
+	}
+	filename := filepath.Join(dir, safeFileName(address)+".lock")
+	file, err := openPoolLock(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open pool lock file: %v", err)
+	}
+
+	const LOCK_EX = 2
+	const LOCK_NB = 4
+	err = syscall.Flock(int(file.Fd()), LOCK_EX|LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return errPoolHostBusy
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot obtain lock on %s: %v", filename, err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot read %s: %v", filename, err)
+	}
+	keeper := strings.TrimSpace(string(data))
+	if keeper != "" && keeper != p.project.Path {
+		debugf("Pool host %s is kept for reuse by %s.", address, keeper)
+		file.Close()
+		return errPoolHostBusy
+	}
+	if p.options.Reuse {
+		err = p.keep(file, p.project.Path)
+	} else if keeper != "" {
+		err = p.keep(file, "")
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write %s: %v", filename, err)
+	}
+
+	p.mu.Lock()
+	p.locks[address] = file
+	p.mu.Unlock()
+	return nil
+}
+
+// openPoolLock opens the lock file, creating it if necessary. Files
+// created by other users are opened without O_CREAT, as systems with
+// fs.protected_regular enabled refuse that in sticky directories.
+func openPoolLock(filename string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(filename, os.O_RDWR, 0)
+		if !os.IsNotExist(err) {
+			return file, err
+		}
+		file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Mode is subject to umask on creation.
+		if err := file.Chmod(0666); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+}
+
+// keep records in the lock file the project keeping the host for reuse,
+// or clears the record if keeper is empty.
+func (p *poolProvider) keep(file *os.File, keeper string) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if keeper == "" {
+		return nil
+	}
+	_, err := file.WriteAt([]byte(keeper+"\n"), 0)
+	return err
+}
+
+func (p *poolProvider) unlock(address string) {
+	p.mu.Lock()
+	file := p.locks[address]
+	delete(p.locks, address)
+	p.mu.Unlock()
+	if file != nil {
+		// The host is not kept for reuse anymore, and closing the
+		// file releases the lock.
+		if err := p.keep(file, ""); err != nil {
+			printf("Cannot clear reuse record of pool host %s: %v", address, err)
+		}
+		file.Close()
+	}
+}
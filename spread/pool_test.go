@@ -0,0 +1,145 @@
+package spread_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type PoolSuite struct {
+	tmpdir   string
+	lockdir  string
+	listener net.Listener
+}
+
+var _ = Suite(&PoolSuite{})
+
+func (s *PoolSuite) SetUpTest(c *C) {
+	s.tmpdir = os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", c.MkDir())
+	s.lockdir = filepath.Join(os.Getenv("TMPDIR"), "spread-pool")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+}
+
+func (s *PoolSuite) TearDownTest(c *C) {
+	s.listener.Close()
+	os.Setenv("TMPDIR", s.tmpdir)
+}
+
+func (s *PoolSuite) system() *spread.System {
+	return &spread.System{
+		Backend:  "pool",
+		Name:     "ubuntu-22.04",
+		Username: "ubuntu",
+		Password: "default",
+		Hosts: []*spread.PoolHost{{
+			Address:  s.listener.Addr().String(),
+			Username: "admin",
+			Password: "secret",
+		}},
+	}
+}
+
+func (s *PoolSuite) provider() spread.Provider {
+	backend := &spread.Backend{Name: "pool", Type: "pool"}
+	return spread.Pool(&spread.Project{}, backend, &spread.Options{})
+}
+
+func (s *PoolSuite) lockFile() string {
+	name := strings.Replace(s.listener.Addr().String(), ":", "_", -1) + ".lock"
+	return filepath.Join(s.lockdir, name)
+}
+
+func (s *PoolSuite) TestAllocateDiscard(c *C) {
+	system := s.system()
+	p1 := s.provider()
+	p2 := s.provider()
+
+	server, err := p1.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, s.listener.Addr().String())
+	c.Assert(server.System().Username, Equals, "admin")
+	c.Assert(server.System().Password, Equals, "secret")
+	c.Assert(system.Username, Equals, "ubuntu")
+
+	// Locks are shared with other providers and processes.
+	_, err = p2.Allocate(system)
+	c.Assert(err, ErrorMatches, `no free hosts in the pool:ubuntu-22.04 pool`)
+
+	c.Assert(server.Discard(), IsNil)
+
+	server, err = p2.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Discard(), IsNil)
+
+	// Locks are usable by every user of the system.
+	info, err := os.Stat(s.lockdir)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode()&os.ModePerm, Equals, os.FileMode(0777))
+	c.Assert(info.Mode()&os.ModeSticky, Equals, os.ModeSticky)
+	info, err = os.Stat(s.lockFile())
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode(), Equals, os.FileMode(0666))
+}
+
+func (s *PoolSuite) TestKeptForReuse(c *C) {
+	system := s.system()
+	backend := &spread.Backend{Name: "pool", Type: "pool"}
+	p1 := spread.Pool(&spread.Project{Path: "/project-one"}, backend, &spread.Options{Reuse: true})
+	p2 := spread.Pool(&spread.Project{Path: "/project-two"}, backend, &spread.Options{})
+
+	server, err := p1.Allocate(system)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(s.lockFile())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "/project-one\n")
+
+	// The record outlives the lock, which is released when the
+	// process that kept the host for reuse terminates.
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(ioutil.WriteFile(s.lockFile(), data, 0666), IsNil)
+
+	_, err = p2.Allocate(system)
+	c.Assert(err, ErrorMatches, `no free hosts in the pool:ubuntu-22.04 pool`)
+
+	rsystem := &spread.ReuseSystem{Name: system.Name, Address: s.listener.Addr().String()}
+	server, err = p1.Reuse(rsystem, system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Discard(), IsNil)
+	data, err = ioutil.ReadFile(s.lockFile())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "")
+
+	server, err = p2.Allocate(system)
+	c.Assert(err, IsNil)
+	c.Assert(server.Discard(), IsNil)
+}
+
+func (s *PoolSuite) TestReuse(c *C) {
+	system := s.system()
+	p1 := s.provider()
+	p2 := s.provider()
+
+	rsystem := &spread.ReuseSystem{Name: system.Name, Address: s.listener.Addr().String()}
+	server, err := p1.Reuse(rsystem, system)
+	c.Assert(err, IsNil)
+	c.Assert(server.System().Username, Equals, "admin")
+
+	_, err = p2.Reuse(rsystem, system)
+	c.Assert(err, ErrorMatches, "pool host is busy")
+
+	c.Assert(server.Discard(), IsNil)
+
+	rsystem.Address = "10.0.0.1"
+	_, err = p2.Reuse(rsystem, system)
+	c.Assert(err, ErrorMatches, `10.0.0.1 is not in the pool:ubuntu-22.04 pool anymore`)
+}
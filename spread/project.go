@@ -38,6 +38,9 @@ type Project struct {
 	Exclude []string
 	Rename  []string
 
+	Artifacts []string
+	Retries   *int
+
 	Path string `yaml:"-"`
 
 	WarnTimeout Timeout `yaml:"warn-timeout"`
@@ -55,8 +58,34 @@ type Backend struct {
 	Allocate string
 	Discard  string
 
+	// Only for lxd.
+	Remote string
+
+	// Only for docker.
+	Engine string
+
+	// Only for plugin.
+	Plugin string
+
+	// Only for local.
+	TempDir bool `yaml:"temp-dir"`
+
 	Systems SystemsMap
 
+	// Reset defines how servers are recovered after a failed
+	// task restore. With "snapshot", the server is reset to a
+	// snapshot saved after the project and backend were prepared.
+	Reset string
+
+	// KnownHosts is the path of a known_hosts file with the host
+	// keys of the backend servers, relative to the project if not
+	// absolute. Host keys are otherwise trusted on first use.
+	KnownHosts string `yaml:"known-hosts"`
+
+	// Proxy holds the jump hosts that servers are reached through,
+	// unless overridden by the system.
+	Proxy ProxyChain
+
 	Prepare     string
 	Restore     string
 	Debug       string
@@ -70,10 +99,28 @@ type Backend struct {
 	WarnTimeout Timeout `yaml:"warn-timeout"`
 	KillTimeout Timeout `yaml:"kill-timeout"`
 	HaltTimeout Timeout `yaml:"halt-timeout"`
+
+	// Fields holds all the fields of the backend as loaded, including
+	// those specific to its type that spread knows nothing about.
+	Fields map[string]interface{} `yaml:"-"`
 }
 
 func (b *Backend) String() string { return fmt.Sprintf("backend %q", b.Name) }
 
+func (b *Backend) UnmarshalYAML(u func(interface{}) error) error {
+	type norecurse Backend
+	if err := u((*norecurse)(b)); err != nil {
+		return err
+	}
+	return u(&b.Fields)
+}
+
+// DecodeFields decodes the fields of the backend into v, which is
+// usually a struct with the fields specific to the backend type.
+func (b *Backend) DecodeFields(v interface{}) error {
+	return decodeFields(b.Fields, v)
+}
+
 func (b *Backend) systemNames() []string {
 	sysnames := make([]string, 0, len(b.Systems))
 	for sysname := range b.Systems {
@@ -107,8 +154,35 @@ type System struct {
 	Password string
 	Workers  int
 
+	// Key is the path of the private key used to connect to the
+	// system over SSH, relative to the project if not absolute.
+	Key string
+
+	// Proxy holds the jump hosts that the system is reached through.
+	Proxy ProxyChain
+
+	// Only for lxd.
+	VM       bool `yaml:"vm"`
+	Profiles []string
+	Config   map[string]string
+	Devices  map[string]map[string]string
+
+	// Only for pool.
+	Hosts []*PoolHost
+
+	// Only for qemu.
+	Memory    string
+	CPUs      int
+	QemuArgs  []string `yaml:"qemu-args"`
+	ImagePath string   `yaml:"image-path"`
+	Disks     []string
+
 	Environment *Environment
 	Variants    []string
+
+	// Fields holds all the fields of the system as loaded, including
+	// those specific to its backend type that spread knows nothing about.
+	Fields map[string]interface{} `yaml:"-" json:"-"`
 }
 
 func (system *System) String() string { return system.Backend + ":" + system.Name }
@@ -123,16 +197,35 @@ func (system *System) UnmarshalYAML(u func(interface{}) error) error {
 	if err := u(&def); err != nil {
 		return err
 	}
+	var fields map[string]map[string]interface{}
+	if err := u(&fields); err != nil {
+		return err
+	}
 	for name, sys := range def {
 		sys.Name = name
 		if sys.Image == "" {
 			sys.Image = name
 		}
+		sys.Fields = fields[name]
 		*system = System(sys)
 	}
 	return nil
 }
 
+// DecodeFields decodes the fields of the system into v, which is
+// usually a struct with the fields specific to the backend type.
+func (system *System) DecodeFields(v interface{}) error {
+	return decodeFields(system.Fields, v)
+}
+
+func decodeFields(fields map[string]interface{}, v interface{}) error {
+	data, err := yaml.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("cannot marshal fields: %v", err)
+	}
+	return yaml.Unmarshal(data, v)
+}
+
 type Environment struct {
 	err  error
 	keys []string
@@ -291,6 +384,9 @@ type Suite struct {
 	RestoreEach string `yaml:"restore-each"`
 	DebugEach   string `yaml:"debug-each"`
 
+	Artifacts []string
+	Retries   *int
+
 	Name  string           `yaml:"-"`
 	Path  string           `yaml:"-"`
 	Tasks map[string]*Task `yaml:"-"`
@@ -319,6 +415,9 @@ type Task struct {
 
 	Disable string
 
+	Artifacts []string
+	Retries   *int
+
 	Name string `yaml:"-"`
 	Path string `yaml:"-"`
 
@@ -372,6 +471,26 @@ func (job *Job) Debug() string {
 	return join(job.Task.Debug, job.Suite.DebugEach, job.Backend.DebugEach, job.Project.DebugEach)
 }
 
+func (job *Job) Artifacts() []string {
+	var artifacts []string
+	artifacts = append(artifacts, job.Project.Artifacts...)
+	artifacts = append(artifacts, job.Suite.Artifacts...)
+	artifacts = append(artifacts, job.Task.Artifacts...)
+	return artifacts
+}
+
+// Retries returns how many times the job may be retried after failing,
+// as defined in the task, suite, or project, in that order. An explicit
+// zero disables retries defined further up.
+func (job *Job) Retries() int {
+	for _, retries := range []*int{job.Task.Retries, job.Suite.Retries, job.Project.Retries} {
+		if retries != nil {
+			return *retries
+		}
+	}
+	return 0
+}
+
 func (job *Job) WarnTimeoutFor(context interface{}) time.Duration {
 	touts := []Timeout{job.Task.WarnTimeout, job.Suite.WarnTimeout, job.Backend.WarnTimeout, job.Project.WarnTimeout}
 	return job.timeoutFor("warn", context, touts)
@@ -462,6 +581,9 @@ func Load(path string) (*Project, error) {
 	if err := checkEnv(project, &project.Environment); err != nil {
 		return nil, err
 	}
+	if err := checkRetries(project, project.Retries); err != nil {
+		return nil, err
+	}
 
 	for bname, backend := range project.Backends {
 		if !validName.MatchString(bname) {
@@ -475,17 +597,18 @@ func Load(path string) (*Project, error) {
 		if backend.Type == "" {
 			backend.Type = bname
 		}
-		switch backend.Type {
-		case "linode", "lxd", "qemu", "adhoc":
-		default:
-			return nil, fmt.Errorf("%s has unsupported type %q", backend, backend.Type)
-		}
 
-		if backend.Type != "adhoc" && (backend.Allocate != "" || backend.Discard != "") {
-			return nil, fmt.Errorf("%s cannot use allocate and dispose fields", backend)
+		if err := validateBackend(project, backend); err != nil {
+			return nil, err
+		}
+		if backend.Reset != "" && backend.Reset != "snapshot" {
+			return nil, fmt.Errorf("%s has invalid reset value %q, expected \"snapshot\"", backend, backend.Reset)
 		}
-		if backend.Type == "adhoc" && strings.TrimSpace(backend.Allocate) == "" {
-			return nil, fmt.Errorf("%s requires an allocate field", backend)
+		if backend.KnownHosts != "" {
+			backend.KnownHosts = project.localPath(backend.KnownHosts)
+		}
+		if err := project.checkProxy(backend, backend.Proxy, backend.KnownHosts); err != nil {
+			return nil, err
 		}
 
 		backend.Prepare = strings.TrimSpace(backend.Prepare)
@@ -503,6 +626,14 @@ func Load(path string) (*Project, error) {
 			if system.Workers == 0 {
 				system.Workers = 1
 			}
+			if system.Key != "" {
+				system.Key = project.localPath(system.Key)
+			}
+			if len(system.Proxy) == 0 {
+				system.Proxy = backend.Proxy
+			} else if err := project.checkProxy(system, system.Proxy, backend.KnownHosts); err != nil {
+				return nil, err
+			}
 			if err := checkEnv(system, &system.Environment); err != nil {
 				return nil, err
 			}
@@ -559,6 +690,9 @@ func Load(path string) (*Project, error) {
 		if err := checkSystems(suite, suite.Systems); err != nil {
 			return nil, err
 		}
+		if err := checkRetries(suite, suite.Retries); err != nil {
+			return nil, err
+		}
 
 		f, err := os.Open(suite.Path)
 		if err != nil {
@@ -611,6 +745,9 @@ func Load(path string) (*Project, error) {
 			if err := checkSystems(task, task.Systems); err != nil {
 				return nil, err
 			}
+			if err := checkRetries(task, task.Retries); err != nil {
+				return nil, err
+			}
 
 			suite.Tasks[tname] = task
 		}
@@ -657,6 +794,33 @@ func checkEnv(context fmt.Stringer, env **Environment) error {
 	return nil
 }
 
+func checkRetries(context fmt.Stringer, retries *int) error {
+	if retries != nil && *retries < 0 {
+		return fmt.Errorf("%s has negative retries: %d", context, *retries)
+	}
+	return nil
+}
+
+// checkProxy validates the jump hosts in proxy, which are verified with
+// the knownHosts file of the backend unless they define their host key.
+func (p *Project) checkProxy(context fmt.Stringer, proxy ProxyChain, knownHosts string) error {
+	for _, host := range proxy {
+		if host == nil || host.Address == "" {
+			return fmt.Errorf("%s has proxy with empty address", context)
+		}
+		if host.HostKey == "" && knownHosts == "" {
+			return fmt.Errorf("%s has %s without host-key, and no known-hosts to verify it with", context, host)
+		}
+		if host.HostKey == "" {
+			host.KnownHosts = knownHosts
+		}
+		if host.Key != "" {
+			host.Key = p.localPath(host.Key)
+		}
+	}
+	return nil
+}
+
 func checkSystems(context fmt.Stringer, systems []string) error {
 	for _, system := range systems {
 		if strings.HasPrefix(system, "+") || strings.HasPrefix(system, "-") {
@@ -726,6 +890,24 @@ func NewFilter(args []string) (Filter, error) {
 	return &filter{exps}, nil
 }
 
+// localPath returns path with environment variables expanded and,
+// if relative, joined to the project path.
+func (p *Project) localPath(path string) string {
+	path = os.ExpandEnv(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.Path, path)
+	}
+	return path
+}
+
+var unsafeFileChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// safeFileName returns s with any characters that aren't safe in file
+// names, such as the colon in addresses with a port, replaced.
+func safeFileName(s string) string {
+	return unsafeFileChars.ReplaceAllString(s, "_")
+}
+
 func (p *Project) backendNames() []string {
 	bnames := make([]string, 0, len(p.Backends))
 	for bname := range p.Backends {
@@ -840,8 +1022,6 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 							continue
 						}
 						jobs = append(jobs, job)
-
-						backendHasJob[job.Backend.Name] = true
 					}
 				}
 
@@ -849,6 +1029,20 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 		}
 	}
 
+	if options.Shards > 0 && len(jobs) > 0 {
+		timings, err := shardTimings(options)
+		if err != nil {
+			return nil, err
+		}
+		jobs, err = shardJobs(jobs, options.Shard, options.Shards, timings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, job := range jobs {
+		backendHasJob[job.Backend.Name] = true
+	}
+
 	env, err := evalenv(cmdcache, true, penv)
 	if err != nil {
 		return nil, err
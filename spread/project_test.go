@@ -1,6 +1,12 @@
 package spread_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/snapcore/spread/spread"
@@ -53,3 +59,482 @@ func (s *FilterSuite) TestFilter(c *C) {
 		c.Assert(f.Pass(job), Equals, false, Commentf("Filter: %q", s))
 	}
 }
+
+type ShardSuite struct{}
+
+var _ = Suite(&ShardSuite{})
+
+func (s *ShardSuite) TestShard(c *C) {
+	backend := &spread.Backend{Name: "backend"}
+	system := &spread.System{Name: "system"}
+	suites := []*spread.Suite{{Name: "a/"}, {Name: "b/"}, {Name: "c/"}}
+	sizes := []int{2, 2, 5}
+
+	var jobs []*spread.Job
+	for i, suite := range suites {
+		for j := 0; j < sizes[i]; j++ {
+			jobs = append(jobs, &spread.Job{Backend: backend, System: system, Suite: suite})
+		}
+	}
+
+	shards := spread.Shard(jobs, 2, nil)
+	c.Assert(shards, HasLen, 2)
+	c.Assert(shards[0], HasLen, 5)
+	c.Assert(shards[1], HasLen, 4)
+	for _, job := range shards[0] {
+		c.Assert(job.Suite, Equals, suites[2])
+	}
+	c.Assert(spread.Shard(jobs, 2, nil), DeepEquals, shards)
+
+	shards = spread.Shard(jobs, 4, nil)
+	c.Assert(shards, HasLen, 4)
+	var total int
+	for _, shard := range shards {
+		c.Assert(len(shard) <= 3, Equals, true)
+		total += len(shard)
+	}
+	c.Assert(total, Equals, len(jobs))
+}
+
+type LoadSuite struct {
+	dir string
+}
+
+var _ = Suite(&LoadSuite{})
+
+func (s *LoadSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(s.dir, "tests"), 0755), IsNil)
+}
+
+func (s *LoadSuite) load(c *C, content string) (*spread.Project, error) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "spread.yaml"), []byte(content), 0644), IsNil)
+	return spread.Load(s.dir)
+}
+
+func (s *LoadSuite) TestNegativeRetries(c *C) {
+	_, err := s.load(c, `
+project: load-test
+path: /load-test
+retries: -1
+backends:
+    local:
+        systems: [local-host]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, "project has negative retries: -1")
+
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    local:
+        systems: [local-host]
+suites:
+    tests/:
+        summary: Tests
+        retries: -2
+`)
+	c.Assert(err, ErrorMatches, "suite tests/ has negative retries: -2")
+}
+
+func (s *LoadSuite) TestProjectShards(c *C) {
+	for _, name := range []string{"one", "two", "three"} {
+		dir := filepath.Join(s.dir, "tests", name)
+		c.Assert(os.MkdirAll(dir, 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "task.yaml"), []byte("summary: Task\n"), 0644), IsNil)
+	}
+	project, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    local:
+        systems: [local-host]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, IsNil)
+
+	options := &spread.Options{Shard: 2, Shards: 2}
+	shards, err := project.Shards(options)
+	c.Assert(err, IsNil)
+	c.Assert(shards, HasLen, 2)
+	c.Assert(len(shards[0])+len(shards[1]), Equals, 3)
+
+	// The selected shard is the one that Jobs returns.
+	jobs, err := project.Jobs(options)
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), DeepEquals, jobNames(shards[1]))
+}
+
+func (s *LoadSuite) TestRetriesPrecedence(c *C) {
+	zero, two, three := 0, 2, 3
+	tests := []struct {
+		project, suite, task *int
+		retries              int
+	}{
+		{nil, nil, nil, 0},
+		{&two, nil, nil, 2},
+		{&two, &three, nil, 3},
+		{&two, &three, &zero, 0},
+		{&two, &zero, nil, 0},
+		{nil, &zero, &three, 3},
+	}
+	for i, test := range tests {
+		job := &spread.Job{
+			Project: &spread.Project{Retries: test.project},
+			Suite:   &spread.Suite{Retries: test.suite},
+			Task:    &spread.Task{Retries: test.task},
+		}
+		c.Assert(job.Retries(), Equals, test.retries, Commentf("Test #%d", i))
+	}
+}
+
+func (s *ShardSuite) jobs(names ...string) []*spread.Job {
+	backend := &spread.Backend{Name: "backend"}
+	system := &spread.System{Name: "system"}
+	suites := make(map[string]*spread.Suite)
+	var jobs []*spread.Job
+	for _, name := range names {
+		sname := name[:strings.Index(name, "/")+1]
+		if suites[sname] == nil {
+			suites[sname] = &spread.Suite{Name: sname}
+		}
+		jobs = append(jobs, &spread.Job{
+			Name:    "backend:system:" + name,
+			Backend: backend,
+			System:  system,
+			Suite:   suites[sname],
+		})
+	}
+	return jobs
+}
+
+func jobNames(jobs []*spread.Job) []string {
+	var names []string
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	return names
+}
+
+func (s *ShardSuite) TestShardTimings(c *C) {
+	jobs := s.jobs("a/slow", "b/one", "b/two", "c/one", "c/two")
+	timings := &spread.Timings{Jobs: map[string]float64{
+		"backend:system:a/slow": 600,
+		"backend:system:b/one":  60,
+		"backend:system:b/two":  60,
+		"backend:system:c/one":  60,
+		"backend:system:c/two":  60,
+	}}
+
+	// By count, the slow job is just one of many.
+	shards := spread.Shard(jobs, 2, nil)
+	c.Assert(jobNames(shards[0]), DeepEquals, []string{"backend:system:a/slow", "backend:system:b/one", "backend:system:b/two"})
+	c.Assert(jobNames(shards[1]), DeepEquals, []string{"backend:system:c/one", "backend:system:c/two"})
+
+	// By duration, it takes a whole shard alone.
+	shards = spread.Shard(jobs, 2, timings)
+	c.Assert(jobNames(shards[0]), DeepEquals, []string{"backend:system:a/slow"})
+	c.Assert(jobNames(shards[1]), DeepEquals, []string{"backend:system:b/one", "backend:system:b/two", "backend:system:c/one", "backend:system:c/two"})
+}
+
+func (s *ShardSuite) TestShardOrdering(c *C) {
+	jobs := s.jobs("a/one", "a/two", "b/one", "c/one", "c/two", "c/three")
+	reversed := make([]*spread.Job, len(jobs))
+	for i, job := range jobs {
+		reversed[len(jobs)-1-i] = job
+	}
+
+	// The same jobs land in the same shards regardless of ordering.
+	for n := 1; n <= 4; n++ {
+		shards := spread.Shard(jobs, n, nil)
+		rshards := spread.Shard(reversed, n, nil)
+		for i := range shards {
+			names := jobNames(shards[i])
+			rnames := jobNames(rshards[i])
+			sort.Strings(names)
+			sort.Strings(rnames)
+			c.Assert(rnames, DeepEquals, names, Commentf("Shard %d/%d", i+1, n))
+		}
+	}
+}
+
+func (s *ShardSuite) TestSortLongestFirst(c *C) {
+	jobs := s.jobs("a/short", "a/unknown", "b/long", "b/medium", "c/other")
+	timings := &spread.Timings{Jobs: map[string]float64{
+		"backend:system:a/short":  10,
+		"backend:system:b/long":   90,
+		"backend:system:b/medium": 50,
+		"backend:system:c/other":  50,
+	}}
+
+	// Unknown jobs take the mean, and equal ones keep their ordering.
+	timings.SortLongestFirst(jobs)
+	c.Assert(jobNames(jobs), DeepEquals, []string{
+		"backend:system:b/long",
+		"backend:system:a/unknown",
+		"backend:system:b/medium",
+		"backend:system:c/other",
+		"backend:system:a/short",
+	})
+
+	// Nothing known means nothing is reordered.
+	jobs = s.jobs("b/two", "a/one")
+	(&spread.Timings{}).SortLongestFirst(jobs)
+	c.Assert(jobNames(jobs), DeepEquals, []string{"backend:system:b/two", "backend:system:a/one"})
+}
+
+var fakeValidated []string
+
+func init() {
+	fakeProvider := func(p *spread.Project, b *spread.Backend, o *spread.Options) spread.Provider { return nil }
+	spread.RegisterProvider("fake", fakeProvider)
+	spread.RegisterValidator("fake", func(p *spread.Project, b *spread.Backend) error {
+		fakeValidated = append(fakeValidated, b.Name)
+		var fields struct{ Flavor string }
+		if err := b.DecodeFields(&fields); err != nil {
+			return err
+		}
+		if fields.Flavor == "bad" {
+			return fmt.Errorf("%s has bad flavor", b)
+		}
+		return nil
+	})
+	spread.RegisterFields("fake", "flavor", "color")
+	spread.RegisterProvider("fake-plain", fakeProvider)
+}
+
+func (s *LoadSuite) TestRegisteredValidator(c *C) {
+	fakeValidated = nil
+	project, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    one:
+        type: fake
+        flavor: good
+        systems:
+            - fake-system:
+                color: blue
+    two:
+        type: fake
+        systems: [fake-system]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, IsNil)
+	sort.Strings(fakeValidated)
+	c.Assert(fakeValidated, DeepEquals, []string{"one", "two"})
+
+	var fields struct{ Color string }
+	c.Assert(project.Backends["one"].Systems["fake-system"].DecodeFields(&fields), IsNil)
+	c.Assert(fields.Color, Equals, "blue")
+
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    fake:
+        flavor: bad
+        systems: [fake-system]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "fake" has bad flavor`)
+}
+
+func (s *LoadSuite) TestKnownHostsPath(c *C) {
+	os.Setenv("SPREAD_TEST_KEYS", "/etc/keys")
+	defer os.Unsetenv("SPREAD_TEST_KEYS")
+
+	project, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    relative:
+        type: adhoc
+        allocate: ADDRESS localhost
+        known-hosts: keys/known_hosts
+        systems: [ubuntu-22.04]
+    absolute:
+        type: adhoc
+        allocate: ADDRESS localhost
+        known-hosts: $SPREAD_TEST_KEYS/known_hosts
+        systems: [ubuntu-22.04]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["relative"].KnownHosts, Equals, filepath.Join(s.dir, "keys/known_hosts"))
+	c.Assert(project.Backends["absolute"].KnownHosts, Equals, "/etc/keys/known_hosts")
+}
+
+func (s *LoadSuite) TestProxy(c *C) {
+	project, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    pool:
+        proxy: tester@bastion.example.com:2222
+        known-hosts: keys/known_hosts
+        systems:
+            - ubuntu-16.04:
+                hosts: [10.0.0.5]
+            - ubuntu-18.04:
+                hosts: [192.168.1.5]
+                proxy:
+                    - gateway.example.com
+                    - address: inner.example.com
+                      username: inner
+                      password: secret
+                      key: keys/inner
+                      host-key: ecdsa-sha2-nistp256 AAAA
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, IsNil)
+	knownHosts := filepath.Join(s.dir, "keys/known_hosts")
+	backend := project.Backends["pool"]
+	c.Assert(backend.Proxy, DeepEquals, spread.ProxyChain{
+		{Address: "bastion.example.com:2222", Username: "tester", KnownHosts: knownHosts},
+	})
+
+	// Systems use the proxy of the backend unless they define one.
+	c.Assert(backend.Systems["ubuntu-16.04"].Proxy, DeepEquals, backend.Proxy)
+	c.Assert(backend.Systems["ubuntu-18.04"].Proxy, DeepEquals, spread.ProxyChain{
+		{Address: "gateway.example.com", KnownHosts: knownHosts},
+		{Address: "inner.example.com", Username: "inner", Password: "secret",
+			Key: filepath.Join(s.dir, "keys/inner"), HostKey: "ecdsa-sha2-nistp256 AAAA"},
+	})
+}
+
+func (s *LoadSuite) TestProxyHostKey(c *C) {
+	_, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    pool:
+        proxy: tester@bastion.example.com
+        systems:
+            - ubuntu-16.04:
+                hosts: [10.0.0.5]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "pool" has proxy bastion.example.com without host-key, and no known-hosts to verify it with`)
+}
+
+func (s *LoadSuite) TestForeignFields(c *C) {
+	// Types without a validator may not use fields of other types.
+	_, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    fake-plain:
+        systems:
+            - fake-system:
+                memory: 4G
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "fake-plain" cannot use memory field in system "fake-system"`)
+
+	// Built-in types may not use the fields of registered ones either.
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    qemu:
+        flavor: good
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "qemu" cannot use flavor field`)
+
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    lxd:
+        engine: podman
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "lxd" cannot use engine field`)
+
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    unknown:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "unknown" has unsupported type "unknown"`)
+}
+
+func (s *LoadSuite) TestLinodeFields(c *C) {
+	_, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    linode:
+        systems: [ubuntu-22.04]
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "linode" requires a key field`)
+
+	_, err = s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    linode:
+        key: "$(HOST: echo $LINODE_KEY)"
+        halt-timeout: 6h
+        systems:
+            - ubuntu-22.04:
+                kernel: GRUB 2
+    qemu:
+        systems:
+            - ubuntu-22.04:
+                kernel: GRUB 2
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "qemu" cannot use kernel field in system "ubuntu-22.04"`)
+}
+
+func (s *LoadSuite) TestNspawnImage(c *C) {
+	_, err := s.load(c, `
+project: load-test
+path: /load-test
+backends:
+    nspawn:
+        systems:
+            - ubuntu-22.04:
+                image: ../jammy
+suites:
+    tests/:
+        summary: Tests
+`)
+	c.Assert(err, ErrorMatches, `backend "nspawn" has system "ubuntu-22.04" with image "../jammy" that is neither a name nor an absolute path`)
+}
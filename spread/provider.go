@@ -3,6 +3,8 @@ package spread
 import (
 	"fmt"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -23,6 +25,143 @@ type Server interface {
 	String() string
 }
 
+// BackendValidator checks the fields of a backend when the project is
+// loaded, before defaults such as the number of workers of its systems
+// are set. It may set defaults for fields specific to its own type.
+type BackendValidator func(p *Project, b *Backend) error
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]func(*Project, *Backend, *Options) Provider)
+	validators  = make(map[string]BackendValidator)
+	fieldTypes  = make(map[string]map[string]bool)
+)
+
+// RegisterProvider makes factory available for creating the providers of
+// backends with the given type. RegisterProvider panics if a provider was
+// already registered for the same type, or if factory is nil.
+func RegisterProvider(typeName string, factory func(*Project, *Backend, *Options) Provider) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("spread: RegisterProvider factory is nil")
+	}
+	if _, dup := factories[typeName]; dup {
+		panic("spread: RegisterProvider called twice for type " + typeName)
+	}
+	factories[typeName] = factory
+}
+
+// RegisterValidator makes validate available for checking backends with
+// the given type when projects are loaded. Backends of types without a
+// validator may not use any fields specific to other types.
+// RegisterValidator panics if a validator was already registered for
+// the same type, or if validate is nil.
+func RegisterValidator(typeName string, validate BackendValidator) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if validate == nil {
+		panic("spread: RegisterValidator validate is nil")
+	}
+	if _, dup := validators[typeName]; dup {
+		panic("spread: RegisterValidator called twice for type " + typeName)
+	}
+	validators[typeName] = validate
+}
+
+// RegisterFields claims the named fields for backends with the given
+// type. The fields may be set on such backends or on their systems, and
+// backends of types that didn't claim them are rejected for using them.
+// Fields unknown to spread are decoded by providers with DecodeFields.
+func RegisterFields(typeName string, names ...string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	for _, name := range names {
+		if fieldTypes[name] == nil {
+			fieldTypes[name] = make(map[string]bool)
+		}
+		fieldTypes[name][typeName] = true
+	}
+}
+
+// validateBackend checks that backend only uses fields claimed by its
+// type, if any, and then checks it with the validator registered for
+// the type. It fails if no provider is registered for the type.
+func validateBackend(p *Project, b *Backend) error {
+	factoriesMu.RLock()
+	factory := factories[b.Type]
+	validate := validators[b.Type]
+	factoriesMu.RUnlock()
+	if factory == nil {
+		return fmt.Errorf("%s has unsupported type %q", b, b.Type)
+	}
+	if name := foreignField(b.Type, b.Fields); name != "" {
+		return fmt.Errorf("%s cannot use %s field", b, name)
+	}
+	for _, sysname := range b.systemNames() {
+		if name := foreignField(b.Type, b.Systems[sysname].Fields); name != "" {
+			return fmt.Errorf("%s cannot use %s field in system %q", b, name, sysname)
+		}
+	}
+	if validate == nil {
+		return nil
+	}
+	return validate(p, b)
+}
+
+// foreignField returns the first of fields, in sorted order, that was
+// claimed by types other than typeName only, or "" if there's none.
+func foreignField(typeName string, fields map[string]interface{}) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	for _, name := range names {
+		if types := fieldTypes[name]; len(types) > 0 && !types[typeName] {
+			return name
+		}
+	}
+	return ""
+}
+
+// newProvider creates the provider for backend using the factory
+// registered for its type.
+func newProvider(p *Project, b *Backend, o *Options) (Provider, error) {
+	factoriesMu.RLock()
+	factory := factories[b.Type]
+	factoriesMu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("%s has unsupported type %q", b, b.Type)
+	}
+	return factory(p, b, o), nil
+}
+
+// Snapshotter may be implemented by servers that can save their whole
+// state under a name and later restore it.
+type Snapshotter interface {
+	Snapshot(name string) error
+	RestoreSnapshot(name string) error
+}
+
+// ExecServer may be implemented by servers that run scripts by their
+// own means rather than being reached over SSH.
+type ExecServer interface {
+	Server
+	Executor() (Executor, error)
+}
+
+// KeyServer may be implemented by servers that may have the public key
+// in Options.PublicKey authorized for root logins when allocated, so that
+// Options.Password is not needed to reach them again. KeyAuthorized
+// reports whether that was the case.
+type KeyServer interface {
+	Server
+	KeyAuthorized() bool
+}
+
 // FatalError represents an error that cannot be fixed by just retrying.
 type FatalError struct{ error }
 
@@ -0,0 +1,188 @@
+package spread
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ProxyHost is an SSH jump host that servers are reached through.
+type ProxyHost struct {
+	// Address is the host and optional port of the jump host,
+	// optionally prefixed by the username as in user@host:port.
+	Address  string
+	Username string
+	Password string
+
+	// Key is the path of the private key used to connect to the
+	// jump host, relative to the project if not absolute.
+	Key string
+
+	// HostKey is the expected host key of the jump host, in the
+	// authorized_keys format.
+	HostKey string `yaml:"host-key"`
+
+	// KnownHosts is the path of the known_hosts file the host key of
+	// the jump host is verified with if HostKey is empty. It is set
+	// to the one of the backend when the project is loaded.
+	KnownHosts string `yaml:"-"`
+}
+
+func (h *ProxyHost) String() string {
+	return "proxy " + h.Address
+}
+
+func (h *ProxyHost) UnmarshalYAML(u func(interface{}) error) error {
+	if err := u(&h.Address); err != nil {
+		type norecurse ProxyHost
+		if err := u((*norecurse)(h)); err != nil {
+			return err
+		}
+	}
+	if i := strings.LastIndex(h.Address, "@"); i >= 0 {
+		h.Username = h.Address[:i]
+		h.Address = h.Address[i+1:]
+	}
+	return nil
+}
+
+func (h *ProxyHost) addr() string {
+	if strings.Contains(h.Address, ":") {
+		return h.Address
+	}
+	return h.Address + ":22"
+}
+
+// ProxyChain holds the jump hosts that servers are reached through,
+// in the order they are connected to.
+type ProxyChain []*ProxyHost
+
+func (c *ProxyChain) UnmarshalYAML(u func(interface{}) error) error {
+	var hosts []*ProxyHost
+	if err := u(&hosts); err == nil {
+		*c = hosts
+		return nil
+	}
+	var host ProxyHost
+	if err := u(&host); err != nil {
+		return err
+	}
+	*c = ProxyChain{&host}
+	return nil
+}
+
+// clientConfig returns the configuration for connecting to the jump
+// host, and a function releasing the resources it holds once the
+// connection is established.
+func (h *ProxyHost) clientConfig() (config *ssh.ClientConfig, done func(), err error) {
+	config = &ssh.ClientConfig{
+		User:    h.Username,
+		Timeout: 10 * time.Second,
+	}
+	if config.User == "" {
+		config.User = username()
+	}
+	switch {
+	case h.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(h.HostKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse host key of %s: %v", h, err)
+		}
+		config.HostKeyCallback = ssh.FixedHostKey(key)
+	case h.KnownHosts != "":
+		config.HostKeyCallback, err = knownhosts.New(h.KnownHosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read known hosts of %s: %v", h, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("cannot verify host key of %s: no host-key or known-hosts defined", h)
+	}
+	if h.Key != "" {
+		key, err := readKey(h.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(key))
+	}
+	if h.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(h.Password))
+	}
+	done = func() {}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			done = func() { conn.Close() }
+		}
+	}
+	return config, done, nil
+}
+
+// sshDial connects to the SSH server at addr through the jump hosts
+// in proxy, if any.
+func sshDial(proxy ProxyChain, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if len(proxy) == 0 {
+		return ssh.Dial("tcp", addr, config)
+	}
+	conn, err := dialPort(proxy, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Enforce the timeout on the handshake as ssh.Dial does.
+	var timer *time.Timer
+	if config.Timeout > 0 {
+		timer = time.AfterFunc(config.Timeout, func() { conn.Close() })
+	}
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if timer != nil && !timer.Stop() && err == nil {
+		sconn.Close()
+		err = fmt.Errorf("ssh: handshake timed out")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sconn, chans, reqs), nil
+}
+
+// dialPort connects to the TCP port at addr through the jump hosts in
+// proxy, if any. Closing the connection also closes the connections
+// to the jump hosts.
+func dialPort(proxy ProxyChain, addr string) (net.Conn, error) {
+	if len(proxy) == 0 {
+		return net.Dial("tcp", addr)
+	}
+	host := proxy[len(proxy)-1]
+	config, done, err := host.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	jump, err := sshDial(proxy[:len(proxy)-1], host.addr(), config)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", host, err)
+	}
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("cannot connect to %s via %s: %v", addr, host, err)
+	}
+	return &proxyConn{conn, jump}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	jump *ssh.Client
+}
+
+func (c *proxyConn) Close() error {
+	err := c.Conn.Close()
+	c.jump.Close()
+	return err
+}
@@ -1,13 +1,26 @@
 package spread
 
 import (
+	"bytes"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+func init() {
+	RegisterProvider("qemu", QEMU)
+	RegisterValidator("qemu", validateQEMU)
+	RegisterFields("qemu", "memory", "cpus", "qemu-args", "image-path", "disks")
+}
+
 func QEMU(p *Project, b *Backend, o *Options) Provider {
 	return &qemuProvider{p, b, o}
 }
@@ -24,10 +37,19 @@ type qemuServer struct {
 
 	system  *System
 	address string
+
+	// booted is whether the guest is known to have come up, and
+	// thus may be asked to shut down cleanly.
+	booted bool
+
+	// keyed is whether the guest booted with a cloud-init seed
+	// authorizing the public key.
+	keyed bool
 }
 
 type qemuServerData struct {
 	PID int
+	Dir string `yaml:",omitempty"`
 }
 
 func (s *qemuServer) String() string {
@@ -50,7 +72,30 @@ func (s *qemuServer) ReuseData() interface{} {
 	return &s.d
 }
 
+func (s *qemuServer) KeyAuthorized() bool {
+	return s.keyed
+}
+
+// qemuPowerdownTimeout is how long a virtual machine has to shut down
+// after being asked to before it gets killed.
+const qemuPowerdownTimeout = 30 * time.Second
+
 func (s *qemuServer) Discard() error {
+	if s.d.Dir != "" {
+		defer os.RemoveAll(s.d.Dir)
+	}
+	if s.d.Dir != "" && s.booted {
+		if err := s.powerdown(); err != nil {
+			debugf("Cannot power down %s gracefully: %v", s, err)
+		} else {
+			return nil
+		}
+	}
+
+	if s.d.PID <= 0 {
+		// Unknown process, so there's nothing to kill.
+		return nil
+	}
 	p, err := os.FindProcess(s.d.PID)
 	if err != nil {
 		return nil // But never happens on Unix, per docs.
@@ -66,6 +111,63 @@ func (s *qemuServer) Discard() error {
 	return nil
 }
 
+// powerdown asks the virtual machine to shut down via QMP and waits
+// until the qemu process terminates.
+func (s *qemuServer) powerdown() error {
+	qmp, err := s.qmp()
+	if err != nil {
+		return err
+	}
+	_, err = qmp.execute("system_powerdown", nil)
+	qmp.Close()
+	if err != nil {
+		return err
+	}
+	timeout := time.After(qemuPowerdownTimeout)
+	retry := time.NewTicker(500 * time.Millisecond)
+	defer retry.Stop()
+	for {
+		if err := syscall.Kill(s.d.PID, 0); err == syscall.ESRCH {
+			return nil
+		}
+		select {
+		case <-retry.C:
+		case <-timeout:
+			return fmt.Errorf("qemu did not terminate within %s", qemuPowerdownTimeout)
+		}
+	}
+}
+
+func (s *qemuServer) qmp() (*qmpClient, error) {
+	if s.d.Dir == "" {
+		return nil, fmt.Errorf("%s has no QMP socket", s)
+	}
+	return dialQMP(filepath.Join(s.d.Dir, "qmp.sock"))
+}
+
+// Snapshot saves the state of the virtual machine under the given name.
+// Snapshots live in the temporary image changes, and thus are gone once
+// the machine is discarded.
+func (s *qemuServer) Snapshot(name string) error {
+	qmp, err := s.qmp()
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+	return qmp.human("savevm " + name)
+}
+
+// RestoreSnapshot restores the state of the virtual machine saved
+// under the given name.
+func (s *qemuServer) RestoreSnapshot(name string) error {
+	qmp, err := s.qmp()
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+	return qmp.human("loadvm " + name)
+}
+
 func (p *qemuProvider) Backend() *Backend {
 	return p.backend
 }
@@ -75,56 +177,197 @@ func (p *qemuProvider) Reuse(rsystem *ReuseSystem, system *System) (Server, erro
 		p:       p,
 		system:  system,
 		address: rsystem.Address,
+		booted:  true,
 	}
+	// The server is returned along with errors so that it gets discarded.
 	err := rsystem.UnmarshalData(&s.d)
 	if err != nil {
-		return nil, fmt.Errorf("cannot unmarshal qemu reuse data: %v", err)
+		return s, fmt.Errorf("cannot unmarshal qemu reuse data: %v", err)
+	}
+	if s.d.Dir != "" {
+		qmp, err := s.qmp()
+		if err != nil {
+			return s, err
+		}
+		defer qmp.Close()
+		status, err := qmp.status()
+		if err != nil {
+			return s, err
+		}
+		if status != "running" {
+			return s, fmt.Errorf("qemu %s is not running (status %q)", s, status)
+		}
 	}
 	return s, nil
 }
 
-func systemPath(system *System) string {
-	return os.ExpandEnv("$HOME/.spread/qemu/" + system.Image + ".img")
+var qemuMemory = regexp.MustCompile(`^[0-9]+[MG]?$`)
+
+func validateQEMU(p *Project, b *Backend) error {
+	for _, sysname := range b.systemNames() {
+		system := b.Systems[sysname]
+		if system.Memory != "" && !qemuMemory.MatchString(system.Memory) {
+			return fmt.Errorf("%s has system %q with invalid memory %q (must be like 1500, 1500M, or 4G)", b, sysname, system.Memory)
+		}
+		if system.CPUs < 0 {
+			return fmt.Errorf("%s has system %q with %d cpus", b, sysname, system.CPUs)
+		}
+	}
+	return nil
+}
+
+// qemuPath returns path expanded and made relative to the project.
+func (p *qemuProvider) qemuPath(path string) string {
+	path = os.ExpandEnv(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.project.Path, path)
+	}
+	return path
 }
 
-func (p *qemuProvider) Allocate(system *System) (Server, error) {
-	// FIXME Find an available port more reliably.
-	port := 59301 + rand.Intn(99)
+// systemPath returns the path of the image for system, which is either
+// the image-path field of the system, if that's a file, or the image
+// name with an .img suffix under the image-path directory, which defaults
+// to ~/.spread/qemu.
+func (p *qemuProvider) systemPath(system *System) string {
+	dir := os.ExpandEnv("$HOME/.spread/qemu")
+	if system.ImagePath != "" {
+		path := p.qemuPath(system.ImagePath)
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return path
+		}
+		dir = path
+	}
+	return filepath.Join(dir, system.Image+".img")
+}
 
-	path := systemPath(system)
+func (p *qemuProvider) Allocate(system *System) (Server, error) {
+	path := p.systemPath(system)
 	if info, err := os.Stat(path); err != nil || info.IsDir() {
 		return nil, &FatalError{fmt.Errorf("cannot find qemu image at %s", path)}
 	}
 
-	serial := fmt.Sprintf("telnet::%d,server,nowait", port+100)
-	monitor := fmt.Sprintf("telnet::%d,server,nowait", port+200)
+	var disks []string
+	for _, disk := range system.Disks {
+		disk = p.qemuPath(disk)
+		if info, err := os.Stat(disk); err != nil || info.IsDir() {
+			return nil, &FatalError{fmt.Errorf("cannot find qemu disk at %s", disk)}
+		}
+		disks = append(disks, "-drive", "file="+strings.Replace(disk, ",", ",,", -1)+",if=virtio")
+	}
+
+	memory := system.Memory
+	if memory == "" {
+		memory = "1500"
+	}
+
+	ports, err := freePorts(2)
+	if err != nil {
+		return nil, err
+	}
+	port := ports[0]
+
+	name, err := lxdName(system)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "spread-qemu-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary directory for %s: %v", system, err)
+	}
+	seed, err := cloudInitSeed(dir, name, system, p.options.Password, p.options.PublicKey)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	serial := fmt.Sprintf("telnet::%d,server,nowait", ports[1])
+	monitor := filepath.Join(dir, "monitor.sock")
+	qmp := filepath.Join(dir, "qmp.sock")
 	fwd := fmt.Sprintf("user,hostfwd=tcp::%d-:22", port)
-	cmd := exec.Command("kvm", "-snapshot", "-m", "1500", "-net", "nic", "-net", fwd, "-serial", serial, "-monitor", monitor, path)
+	args := []string{"-snapshot", "-m", memory, "-net", "nic", "-net", fwd, "-serial", serial,
+		"-monitor", "unix:" + monitor + ",server,nowait", "-qmp", "unix:" + qmp + ",server,nowait"}
+	if system.CPUs > 0 {
+		args = append(args, "-smp", strconv.Itoa(system.CPUs))
+	}
+	args = append(args, disks...)
+	if seed != "" {
+		args = append(args, "-cdrom", seed)
+	}
+	args = append(args, system.QemuArgs...)
+	args = append(args, path)
+	cmd := qemuCommand(args...)
 	if os.Getenv("SPREAD_QEMU_GUI") != "1" {
 		cmd.Args = append([]string{cmd.Args[0], "-nographic"}, cmd.Args[1:]...)
 	}
-	printf("Serial port for %q available via 'telnet localhost %d'", system, port+100)
-	printf("Montior port for %q available via 'telnet localhost %d'", system, port+200)
+	printf("Serial port for %q available via 'telnet localhost %d'", system, ports[1])
+	printf("Monitor for %q available via 'socat - UNIX-CONNECT:%s'", system, monitor)
 
-	err := cmd.Start()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
 	if err != nil {
+		os.RemoveAll(dir)
 		return nil, &FatalError{fmt.Errorf("cannot launch qemu %s: %v", system, err)}
 	}
 
+	// Report qemu terminating early, such as when another process
+	// grabbed one of the ports in the meantime, so it gets retried.
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		exited <- fmt.Errorf("qemu exited unexpectedly: %v", outputErr(stderr.Bytes(), err))
+	}()
+
 	s := &qemuServer{
 		p: p,
 		d: qemuServerData{
 			PID: cmd.Process.Pid,
+			Dir: dir,
 		},
 		system:  system,
 		address: "localhost:" + strconv.Itoa(port),
+		keyed:   seed != "" && p.options.PublicKey != "",
 	}
 
 	printf("Waiting for %s to make SSH available...", system)
-	if err := waitPortUp(system, s.address); err != nil {
+	if err := waitPortUpOrAbort(system, s.address, exited); err != nil {
 		s.Discard()
 		return nil, fmt.Errorf("cannot connect to %s: %s", s, err)
 	}
+	s.booted = true
 	printf("Allocated %s.", s)
 	return s, nil
 }
+
+// qemuCommand returns the command for running qemu with the given
+// arguments, using KVM acceleration when it is available and falling
+// back to the much slower software emulation otherwise.
+func qemuCommand(args ...string) *exec.Cmd {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		debugf("Cannot use KVM, falling back to software emulation: %v", err)
+		return exec.Command("qemu-system-x86_64", append([]string{"-accel", "tcg"}, args...)...)
+	}
+	f.Close()
+	if _, err := exec.LookPath("kvm"); err == nil {
+		return exec.Command("kvm", args...)
+	}
+	return exec.Command("qemu-system-x86_64", append([]string{"-accel", "kvm"}, args...)...)
+}
+
+// freePorts returns n distinct local TCP ports that were free at the
+// time of the call. They're found by binding to port zero and letting
+// the system pick, so concurrent allocations get distinct ports.
+func freePorts(n int) ([]int, error) {
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return nil, fmt.Errorf("cannot find free local port: %v", err)
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
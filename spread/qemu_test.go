@@ -0,0 +1,216 @@
+package spread_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeQMP serves the QEMU Machine Protocol on a unix socket, answering
+// the commands spread sends with canned responses.
+type fakeQMP struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	commands  []string
+	status    string
+	output    string
+	powerdown func()
+}
+
+func newFakeQMP(c *C, path string) *fakeQMP {
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	q := &fakeQMP{listener: l, status: "running"}
+	go q.serve()
+	return q
+}
+
+func (q *fakeQMP) serve() {
+	for {
+		conn, err := q.listener.Accept()
+		if err != nil {
+			return
+		}
+		go q.handle(conn)
+	}
+}
+
+func (q *fakeQMP) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var cmd struct {
+			Execute   string
+			Arguments map[string]string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			fmt.Fprintf(conn, `{"error": {"class": "GenericError", "desc": %q}}`+"\n", err)
+			continue
+		}
+		q.mu.Lock()
+		if cmd.Execute != "qmp_capabilities" {
+			q.commands = append(q.commands, cmd.Execute+" "+cmd.Arguments["command-line"])
+		}
+		status, output, powerdown := q.status, q.output, q.powerdown
+		q.mu.Unlock()
+
+		// Events may arrive at any time and must be skipped.
+		fmt.Fprintln(conn, `{"event": "RTC_CHANGE", "data": {}}`)
+		switch cmd.Execute {
+		case "query-status":
+			fmt.Fprintf(conn, `{"return": {"status": %q, "running": true}}`+"\n", status)
+		case "human-monitor-command":
+			fmt.Fprintf(conn, `{"return": %q}`+"\n", output)
+		case "system_powerdown":
+			fmt.Fprintln(conn, `{"return": {}}`)
+			if powerdown != nil {
+				powerdown()
+			}
+		case "qmp_capabilities":
+			fmt.Fprintln(conn, `{"return": {}}`)
+		default:
+			fmt.Fprintf(conn, `{"error": {"class": "CommandNotFound", "desc": "The command %s has not been found"}}`+"\n", cmd.Execute)
+		}
+	}
+}
+
+func (q *fakeQMP) set(status, output string) {
+	q.mu.Lock()
+	q.status, q.output = status, output
+	q.mu.Unlock()
+}
+
+// calls returns the commands received so far and forgets about them.
+func (q *fakeQMP) calls() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	commands := q.commands
+	q.commands = nil
+	return commands
+}
+
+type QEMUSuite struct {
+	dir      string
+	qmp      *fakeQMP
+	cmd      *exec.Cmd
+	done     chan struct{}
+	provider spread.Provider
+	system   *spread.System
+}
+
+var _ = Suite(&QEMUSuite{})
+
+func (s *QEMUSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.qmp = newFakeQMP(c, filepath.Join(s.dir, "qmp.sock"))
+
+	// Stands for the qemu process.
+	s.cmd = exec.Command("sleep", "60")
+	c.Assert(s.cmd.Start(), IsNil)
+	s.done = make(chan struct{})
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+
+	backend := &spread.Backend{Name: "qemu", Type: "qemu"}
+	s.system = &spread.System{Backend: "qemu", Name: "ubuntu-20.04"}
+	s.provider = spread.QEMU(&spread.Project{}, backend, &spread.Options{})
+}
+
+func (s *QEMUSuite) TearDownTest(c *C) {
+	s.qmp.listener.Close()
+	s.cmd.Process.Kill()
+	<-s.done
+}
+
+func (s *QEMUSuite) reuse(c *C, data map[string]interface{}) (spread.Server, error) {
+	rsystem := &spread.ReuseSystem{Address: "localhost:59301", Data: data}
+	return s.provider.Reuse(rsystem, s.system)
+}
+
+func (s *QEMUSuite) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *QEMUSuite) TestReuseStatus(c *C) {
+	data := map[string]interface{}{"pid": s.cmd.Process.Pid, "dir": s.dir}
+	server, err := s.reuse(c, data)
+	c.Assert(err, IsNil)
+	c.Assert(server.Address(), Equals, "localhost:59301")
+	c.Assert(s.qmp.calls(), DeepEquals, []string{"query-status "})
+
+	s.qmp.set("paused", "")
+	server, err = s.reuse(c, data)
+	c.Assert(err, ErrorMatches, `qemu qemu:ubuntu-20.04 is not running \(status "paused"\)`)
+	c.Assert(server, NotNil)
+}
+
+func (s *QEMUSuite) TestReuseBadData(c *C) {
+	server, err := s.reuse(c, map[string]interface{}{"pid": "bad"})
+	c.Assert(err, ErrorMatches, "(?s)cannot unmarshal qemu reuse data: .*")
+
+	// The server is returned so it may be discarded, without killing
+	// a process it knows nothing about.
+	c.Assert(server, NotNil)
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.exited(), Equals, false)
+	c.Assert(s.qmp.calls(), HasLen, 0)
+}
+
+func (s *QEMUSuite) TestSnapshot(c *C) {
+	server, err := s.reuse(c, map[string]interface{}{"pid": s.cmd.Process.Pid, "dir": s.dir})
+	c.Assert(err, IsNil)
+	s.qmp.calls()
+
+	snapshotter := server.(spread.Snapshotter)
+	c.Assert(snapshotter.Snapshot("clean"), IsNil)
+	c.Assert(snapshotter.RestoreSnapshot("clean"), IsNil)
+	c.Assert(s.qmp.calls(), DeepEquals, []string{
+		"human-monitor-command savevm clean",
+		"human-monitor-command loadvm clean",
+	})
+
+	// The human monitor reports errors as output.
+	s.qmp.set("running", "Error: Device 'drive0' is writable but does not support snapshots\r\n")
+	c.Assert(snapshotter.Snapshot("clean"), ErrorMatches, `qemu "savevm clean" failed: Error: Device 'drive0' is writable .*`)
+}
+
+func (s *QEMUSuite) TestDiscardPowerdown(c *C) {
+	s.qmp.powerdown = func() { s.cmd.Process.Kill() }
+
+	server, err := s.reuse(c, map[string]interface{}{"pid": s.cmd.Process.Pid, "dir": s.dir})
+	c.Assert(err, IsNil)
+	s.qmp.calls()
+
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(s.qmp.calls(), DeepEquals, []string{"system_powerdown "})
+	<-s.done
+	_, err = os.Stat(s.dir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *QEMUSuite) TestDiscardKill(c *C) {
+	// Without a QMP socket the process is killed right away.
+	server, err := s.reuse(c, map[string]interface{}{"pid": s.cmd.Process.Pid})
+	c.Assert(err, IsNil)
+	c.Assert(server.Discard(), IsNil)
+	<-s.done
+	c.Assert(s.qmp.calls(), HasLen, 0)
+}
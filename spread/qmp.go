@@ -0,0 +1,129 @@
+package spread
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// qmpClient talks to a qemu process via the QEMU Machine Protocol.
+type qmpClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// dialQMP connects to the QMP unix socket at path and negotiates
+// capabilities so the connection is ready for commands.
+func dialQMP(path string) (*qmpClient, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to qemu QMP socket: %v", err)
+	}
+	c := &qmpClient{conn: conn, scanner: bufio.NewScanner(conn)}
+	c.scanner.Buffer(nil, 1024*1024)
+
+	// Skip the greeting.
+	if _, err := c.read(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := c.execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *qmpClient) read() (*qmpResponse, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	if !c.scanner.Scan() {
+		err := c.scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("connection closed")
+		}
+		return nil, fmt.Errorf("cannot read from qemu QMP socket: %v", err)
+	}
+	var resp qmpResponse
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal qemu QMP response: %v", err)
+	}
+	return &resp, nil
+}
+
+// execute runs the given QMP command and returns its result,
+// skipping any asynchronous events received meanwhile.
+func (c *qmpClient) execute(command string, arguments interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(&qmpCommand{command, arguments})
+	if err != nil {
+		return nil, fmt.Errorf("internal error: cannot marshal qemu QMP command: %v", err)
+	}
+	debugf("Sending QMP command: %s", data)
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("cannot write to qemu QMP socket: %v", err)
+	}
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("qemu %s failed: %s", command, resp.Error.Desc)
+		}
+		return resp.Return, nil
+	}
+}
+
+// human runs a command of the human monitor, for those that have no
+// QMP counterpart such as savevm and loadvm. These commands report
+// errors as their output, so any output is considered an error.
+func (c *qmpClient) human(command string) error {
+	result, err := c.execute("human-monitor-command", map[string]string{"command-line": command})
+	if err != nil {
+		return err
+	}
+	var output string
+	if err := json.Unmarshal(result, &output); err != nil {
+		return fmt.Errorf("cannot unmarshal qemu %q output: %v", command, err)
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("qemu %q failed: %s", command, output)
+	}
+	return nil
+}
+
+// status returns the run state of the virtual machine, such as "running".
+func (c *qmpClient) status() (string, error) {
+	result, err := c.execute("query-status", nil)
+	if err != nil {
+		return "", err
+	}
+	var status struct{ Status string }
+	if err := json.Unmarshal(result, &status); err != nil {
+		return "", fmt.Errorf("cannot unmarshal qemu status: %v", err)
+	}
+	return status.Status, nil
+}
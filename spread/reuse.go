@@ -149,7 +149,10 @@ func werr(n int, err error) error {
 	return err
 }
 
-func (r *Reuse) Add(server Server, password string) error {
+// Add tracks server for reuse. The system credentials are recorded if
+// defined, and otherwise the provided password and key path are, if not
+// empty.
+func (r *Reuse) Add(server Server, password, key string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -162,12 +165,16 @@ func (r *Reuse) Add(server Server, password string) error {
 		Name:     system.Name,
 		Username: system.Username,
 		Password: system.Password,
+		Key:      system.Key,
 		Address:  server.Address(),
 		Data:     server.ReuseData(),
 	}
 	if rsystem.Password == "" {
 		rsystem.Password = password
 	}
+	if rsystem.Key == "" {
+		rsystem.Key = key
+	}
 
 	rbackend, ok := r.backends[system.Backend]
 	if !ok {
@@ -180,6 +187,29 @@ func (r *Reuse) Add(server Server, password string) error {
 	return r.write()
 }
 
+// SetHostKey records hostKey, in authorized_keys format, as the host
+// key of server, which must have been added before.
+func (r *Reuse) SetHostKey(server Server, hostKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rbackend, ok := r.backends[server.System().Backend]
+	if !ok {
+		return nil
+	}
+	address := server.Address()
+	for _, rsystem := range rbackend.Systems {
+		if rsystem.Address == address {
+			if rsystem.HostKey == hostKey {
+				return nil
+			}
+			rsystem.HostKey = hostKey
+			return r.write()
+		}
+	}
+	return nil
+}
+
 func (r *Reuse) Remove(server Server) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -215,6 +245,24 @@ func (r *Reuse) has(server Server) bool {
 	return false
 }
 
+// hasAddress returns whether a server of the named backend at address
+// is tracked for reuse.
+func (r *Reuse) hasAddress(bname, address string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rbackend, ok := r.backends[bname]
+	if !ok {
+		return false
+	}
+	for _, rsystem := range rbackend.Systems {
+		if rsystem.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Reuse) ReuseSystems(system *System) []*ReuseSystem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -241,8 +289,10 @@ type ReuseBackend struct {
 type ReuseSystem struct {
 	Name     string `yaml:"-"`
 	Username string `yaml:",omitempty"`
-	Password string
+	Password string `yaml:",omitempty"`
+	Key      string `yaml:",omitempty"`
 	Address  string
+	HostKey  string      `yaml:"host-key,omitempty"`
 	Data     interface{} `yaml:",omitempty"`
 }
 
@@ -0,0 +1,165 @@
+package spread_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/spread/spread"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "gopkg.in/check.v1"
+)
+
+type ReuseSuite struct {
+	// sshd is not embedded so its tests don't run again here.
+	sshd   ClientSuite
+	dir    string
+	logger *log.Logger
+	output bytes.Buffer
+}
+
+var _ = Suite(&ReuseSuite{})
+
+func (s *ReuseSuite) SetUpTest(c *C) {
+	s.sshd.SetUpTest(c)
+	s.dir = c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(s.dir, "tests"), 0755), IsNil)
+
+	s.output.Reset()
+	s.logger = spread.Logger
+	spread.Logger = log.New(&s.output, "", 0)
+}
+
+func (s *ReuseSuite) TearDownTest(c *C) {
+	spread.Logger = s.logger
+	s.sshd.TearDownTest(c)
+}
+
+func (s *ReuseSuite) write(c *C, name, content string) {
+	path := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+// project writes and loads a project with an adhoc backend running the
+// given allocate script, and a system that logs into the fake SSH server.
+func (s *ReuseSuite) project(c *C, allocate, extra string) *spread.Project {
+	s.write(c, "spread.yaml", `
+project: reuse-test
+path: /reuse-test
+backends:
+    adhoc:
+        allocate: `+allocate+`
+        discard: touch discarded
+`+extra+`
+        systems:
+            - ubuntu-22.04:
+                username: jump
+                password: bastion
+suites:
+    tests/:
+        summary: Tests
+`)
+	s.write(c, "tests/task/task.yaml", "summary: Task\nexecute: true\n")
+	project, err := spread.Load(s.dir)
+	c.Assert(err, IsNil)
+	return project
+}
+
+func (s *ReuseSuite) TestHostKeyRoundTrip(c *C) {
+	filename := filepath.Join(s.dir, ".spread-reuse.yaml")
+	system := &spread.System{Backend: "adhoc", Name: "ubuntu-22.04"}
+	server := &proxiedServer{spread.UnknownServer{Addr: "10.0.0.1:22"}, system}
+	hostKey := authorizedKey(s.sshd.hostKey.PublicKey())
+
+	reuse, err := spread.OpenReuse(filename)
+	c.Assert(err, IsNil)
+	c.Assert(reuse.Add(server, "", "/path/to/key"), IsNil)
+	c.Assert(reuse.SetHostKey(server, hostKey), IsNil)
+	reuse.Close()
+
+	reuse, err = spread.OpenReuse(filename)
+	c.Assert(err, IsNil)
+	defer reuse.Close()
+	rsystems := reuse.ReuseSystems(system)
+	c.Assert(rsystems, HasLen, 1)
+	c.Assert(rsystems[0].Address, Equals, "10.0.0.1:22")
+	c.Assert(rsystems[0].Key, Equals, "/path/to/key")
+	c.Assert(rsystems[0].HostKey, Equals, hostKey)
+}
+
+func (s *ReuseSuite) TestReuseChangedHostKey(c *C) {
+	addr := s.sshd.listener.Addr().String()
+	project := s.project(c, "FATAL no more servers", "")
+	s.write(c, ".spread-reuse.yaml", `
+backends:
+    adhoc:
+        systems:
+            - ubuntu-22.04:
+                username: jump
+                password: bastion
+                address: `+addr+`
+                host-key: `+authorizedKey(newKey(c).PublicKey())+`
+`)
+
+	runner, err := spread.Start(project, &spread.Options{Reuse: true})
+	c.Assert(err, IsNil)
+	runner.Wait()
+
+	c.Assert(s.output.String(), Matches, `(?s).*Discarding adhoc:ubuntu-22.04, cannot verify host key: .*ssh: host key mismatch.*`)
+	_, err = os.Stat(filepath.Join(s.dir, "discarded"))
+	c.Assert(err, IsNil)
+
+	reuse, err := spread.OpenReuse(filepath.Join(s.dir, ".spread-reuse.yaml"))
+	c.Assert(err, IsNil)
+	defer reuse.Close()
+	c.Assert(reuse.ReuseSystems(project.Backends["adhoc"].Systems["ubuntu-22.04"]), HasLen, 0)
+}
+
+func (s *ReuseSuite) TestKnownHostsMismatch(c *C) {
+	addr := s.sshd.listener.Addr().String()
+	s.write(c, "keys/known_hosts", knownhosts.Line([]string{addr}, newKey(c).PublicKey())+"\n")
+	project := s.project(c, "ADDRESS "+addr, "        known-hosts: keys/known_hosts")
+
+	// Mismatching host keys are not retried as if SSH wasn't up yet.
+	start := time.Now()
+	runner, err := spread.Start(project, &spread.Options{})
+	c.Assert(err, IsNil)
+	runner.Wait()
+	c.Assert(time.Since(start) < 30*time.Second, Equals, true)
+
+	c.Assert(s.output.String(), Matches, `(?s).*Discarding adhoc:ubuntu-22.04, cannot verify host key: .*knownhosts: key mismatch.*`)
+	_, err = os.Stat(filepath.Join(s.dir, "discarded"))
+	c.Assert(err, IsNil)
+}
+
+func (s *ReuseSuite) TestReuseRecordsHostKey(c *C) {
+	addr := s.sshd.listener.Addr().String()
+	project := s.project(c, "FATAL no more servers", "")
+
+	// Entries tracked before host keys were recorded get theirs.
+	s.write(c, ".spread-reuse.yaml", `
+backends:
+    adhoc:
+        systems:
+            - ubuntu-22.04:
+                username: jump
+                password: bastion
+                address: `+addr+`
+`)
+
+	runner, err := spread.Start(project, &spread.Options{Reuse: true})
+	c.Assert(err, IsNil)
+	runner.Wait()
+
+	reuse, err := spread.OpenReuse(filepath.Join(s.dir, ".spread-reuse.yaml"))
+	c.Assert(err, IsNil)
+	defer reuse.Close()
+	rsystems := reuse.ReuseSystems(project.Backends["adhoc"].Systems["ubuntu-22.04"])
+	c.Assert(rsystems, HasLen, 1)
+	c.Assert(rsystems[0].HostKey, Equals, authorizedKey(s.sshd.hostKey.PublicKey()))
+}
@@ -9,11 +9,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/tomb.v2"
 )
 
@@ -30,6 +33,23 @@ type Options struct {
 	Restore     bool
 	Resend      bool
 	Discard     bool
+	JUnit       string
+	Events      func(ev Event)
+	Logs        string
+	Artifacts   string
+	Retries     int
+	RetryFresh  bool
+	Shard       int
+	Shards      int
+
+	// ShardTimings is the path of a timings file shared by all
+	// shards of a run for balancing them. Shards are balanced by
+	// job count if it is empty.
+	ShardTimings string
+
+	// PublicKey holds the public part of the SSH key generated for
+	// the run, in authorized_keys format. It is set by Start.
+	PublicKey string
 }
 
 type Runner struct {
@@ -48,10 +68,19 @@ type Runner struct {
 	alive int
 
 	reuse    *Reuse
+	key      ssh.Signer
 	reserved map[string]bool
 	servers  []Server
 	pending  []*Job
 	stats    stats
+	outputs  map[string]string
+	timings  *Timings
+
+	// knownHosts verifies host keys of servers in backends
+	// with a known-hosts file, by backend name.
+	knownHosts map[string]ssh.HostKeyCallback
+
+	eventsMu sync.Mutex
 
 	allocated bool
 
@@ -64,22 +93,26 @@ func Start(project *Project, options *Options) (*Runner, error) {
 		options:   options,
 		providers: make(map[string]Provider),
 		reserved:  make(map[string]bool),
+		outputs:   make(map[string]string),
+
+		knownHosts: make(map[string]ssh.HostKeyCallback),
 
 		suiteWorkers: make(map[[3]string]int),
 	}
 
 	for bname, backend := range project.Backends {
-		switch backend.Type {
-		case "linode":
-			r.providers[bname] = Linode(project, backend, options)
-		case "lxd":
-			r.providers[bname] = LXD(project, backend, options)
-		case "qemu":
-			r.providers[bname] = QEMU(project, backend, options)
-		case "adhoc":
-			r.providers[bname] = AdHoc(project, backend, options)
-		default:
-			return nil, fmt.Errorf("%s has unsupported type %q", backend, backend.Type)
+		provider, err := newProvider(project, backend, options)
+		if err != nil {
+			return nil, err
+		}
+		r.providers[bname] = provider
+
+		if backend.KnownHosts != "" {
+			hostKey, err := knownhosts.New(backend.KnownHosts)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read known hosts of %s: %v", backend, err)
+			}
+			r.knownHosts[bname] = hostKey
 		}
 	}
 
@@ -89,11 +122,25 @@ func Start(project *Project, options *Options) (*Runner, error) {
 	}
 	r.pending = pending
 
+	r.timings, err = ReadTimings(project)
+	if err != nil {
+		return nil, err
+	}
+	r.timings.sortLongestFirst(r.pending)
+
 	r.reuse, err = OpenReuse(r.reusePath())
 	if err != nil {
 		return nil, err
 	}
 
+	// Providers only use the key once allocating servers.
+	r.key, err = r.runKey()
+	if err != nil {
+		r.reuse.Close()
+		return nil, err
+	}
+	options.PublicKey = authorizedKey(r.key)
+
 	r.tomb.Go(r.loop)
 	return r, nil
 }
@@ -108,6 +155,20 @@ func (r *Runner) reusePath() string {
 	return filepath.Join(r.project.Path, fmt.Sprintf(".spread-reuse.%d.yaml", os.Getpid()))
 }
 
+// keyPath returns the path of the SSH key generated for the run, which
+// lives along with the reuse file so that reused servers remain reachable.
+func (r *Runner) keyPath() string {
+	return strings.TrimSuffix(r.reusePath(), ".yaml") + ".key"
+}
+
+// runKey returns the SSH key at keyPath, generating it if necessary.
+func (r *Runner) runKey() (ssh.Signer, error) {
+	if _, err := os.Stat(r.keyPath()); err == nil {
+		return readKey(r.keyPath())
+	}
+	return createKey(r.keyPath())
+}
+
 type projectContent struct {
 	fd  *os.File
 	err error
@@ -138,6 +199,23 @@ func (r *Runner) loop() (err error) {
 				}
 			}
 			r.stats.log()
+			r.statsEvent()
+			if r.options.JUnit != "" {
+				if jerr := r.writeJUnit(r.options.JUnit); jerr != nil {
+					printf("Error writing JUnit report: %v", jerr)
+					if err == nil {
+						err = jerr
+					}
+				}
+			}
+			if !r.options.Restore {
+				if lerr := r.writeLastRun(); lerr != nil {
+					printf("Error writing results of last run: %v", lerr)
+				}
+				if terr := r.writeTimings(); terr != nil {
+					printf("Error writing job timings: %v", terr)
+				}
+			}
 		}
 		if !r.options.Reuse || r.options.Discard {
 			for len(r.servers) > 0 {
@@ -146,8 +224,12 @@ func (r *Runner) loop() (err error) {
 			}
 			if !r.options.Reuse {
 				os.Remove(r.reusePath())
+				os.Remove(r.keyPath())
 			}
 		}
+		if r.options.Discard {
+			r.reportUntracked()
+		}
 		if len(r.servers) > 0 {
 			for _, server := range r.servers {
 				printf("Keeping %s at %s", server, server.Address())
@@ -245,7 +327,7 @@ func (r *Runner) prepareContent() (err error) {
 		return fmt.Errorf("cannot remove temporary content file: %v", err)
 	}
 
-	args := []string{"c", "--sort=name", "--exclude=.spread-reuse.*"}
+	args := []string{"c", "--sort=name", "--exclude=.spread-reuse.*", "--exclude=.spread-last-run.*", "--exclude=.spread-timings.*"}
 	if r.project.Repack == "" {
 		args[0] = "cz"
 	}
@@ -384,7 +466,7 @@ const (
 	restoring = "restoring"
 )
 
-func (r *Runner) run(client *Client, job *Job, verb string, context interface{}, script, debug string, abend *bool) bool {
+func (r *Runner) run(client Executor, job *Job, verb string, context interface{}, script, debug string, abend *bool) bool {
 	script = strings.TrimSpace(script)
 	if len(script) == 0 {
 		return true
@@ -410,17 +492,25 @@ func (r *Runner) run(client *Client, job *Job, verb string, context interface{},
 	}
 	client.SetWarnTimeout(job.WarnTimeoutFor(context))
 	client.SetKillTimeout(job.KillTimeoutFor(context))
-	_, err := client.Trace(script, dir, job.Environment)
+	started, finished := scriptEventTypes(verb)
+	r.scriptEvent(started, client, job, context, nil)
+	traced, err := client.Trace(script, dir, job.Environment)
+	r.scriptEvent(finished, client, job, context, err)
+	r.logOutput(client, job, verb, context, traced, err)
 	if err != nil {
 		printf("Error %s %s : %v", verb, contextStr, err)
+		output := err.Error()
 		if debug != "" {
-			output, err := client.Trace(debug, dir, job.Environment)
+			dbgout, err := client.Trace(debug, dir, job.Environment)
+			r.logOutput(client, job, "debugging", context, dbgout, err)
 			if err != nil {
 				printf("Error debugging %s : %v", contextStr, err)
-			} else if len(output) > 0 {
-				printf("Debug output for %s : %v", contextStr, outputErr(output, nil))
+			} else if len(dbgout) > 0 {
+				printf("Debug output for %s : %v", contextStr, outputErr(dbgout, nil))
+				output += "\n\nDebug output:\n" + string(dbgout)
 			}
 		}
+		r.addOutput(verb, contextStr, output)
 		if r.options.Debug || r.options.ShellAfter {
 			printf("Starting shell to debug...")
 			err = client.Shell("", dir, r.shellEnv(job, job.Environment))
@@ -444,6 +534,64 @@ func (r *Runner) run(client *Client, job *Job, verb string, context interface{},
 	return true
 }
 
+// addOutput records the output of a failed script so it may be included
+// in reports once the run is over.
+func (r *Runner) addOutput(verb, contextStr, output string) {
+	r.mu.Lock()
+	r.outputs[verb+" "+contextStr] = output
+	r.mu.Unlock()
+}
+
+func scriptEventTypes(verb string) (started, finished string) {
+	switch verb {
+	case preparing:
+		return PrepareStarted, PrepareFinished
+	case executing:
+		return ExecuteStarted, ExecuteFinished
+	case restoring:
+		return RestoreStarted, RestoreFinished
+	}
+	panic("internal error: unknown script verb " + verb)
+}
+
+// fetchArtifacts retrieves the artifacts of job from the server into
+// a directory named after the job under Options.Artifacts, if set.
+func (r *Runner) fetchArtifacts(client Executor, job *Job) {
+	artifacts := job.Artifacts()
+	if r.options.Artifacts == "" || len(artifacts) == 0 {
+		return
+	}
+	logf("Fetching artifacts of %s...", job)
+
+	dir := filepath.Join(r.options.Artifacts, job.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		printf("Cannot create artifacts directory for %s: %v", job, err)
+		return
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("tar", "xz")
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		printf("Cannot fetch artifacts of %s: %v", job, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		printf("Cannot start local tar command: %v", err)
+		return
+	}
+	err = client.RecvTar(filepath.Join(r.project.RemotePath, job.Task.Name), artifacts, stdin)
+	stdin.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("local tar command returned error: %v", outputErr(stderr.Bytes(), werr))
+	}
+	if err != nil {
+		printf("Cannot fetch artifacts of %s: %v", job, err)
+	}
+}
+
 func (r *Runner) shellEnv(job *Job, env *Environment) *Environment {
 	senv := env.Copy()
 	senv.Set("PS1", `\$SPREAD_BACKEND:\$SPREAD_SYSTEM \${PWD/#\$SPREAD_PATH/...}# `)
@@ -463,7 +611,7 @@ func suiteWorkersKey(job *Job) [3]string {
 func (r *Runner) worker(backend *Backend, system *System) {
 	defer func() { r.done <- true }()
 
-	client := r.client(backend, system)
+	client := r.client(backend, system, false)
 	if client == nil {
 		return
 	}
@@ -478,8 +626,14 @@ func (r *Runner) worker(backend *Backend, system *System) {
 	var insideBackend bool
 	var insideSuite *Suite
 
+	var canReset bool
+
 	var job, last *Job
 
+	// retryJob is retried on a fresh server, starting at retryAttempt.
+	var retryJob *Job
+	var retryAttempt int
+
 	for {
 		r.mu.Lock()
 		if job != nil {
@@ -487,9 +641,18 @@ func (r *Runner) worker(backend *Backend, system *System) {
 		}
 		if badProject || abend || !r.tomb.Alive() {
 			r.mu.Unlock()
+			if retryJob != nil {
+				r.add(&stats.TaskAbort, retryJob)
+			}
 			break
 		}
-		job = r.job(backend, system, insideSuite)
+		firstAttempt := 0
+		if retryJob != nil {
+			job, firstAttempt = retryJob, retryAttempt
+			retryJob = nil
+		} else {
+			job = r.job(backend, system, insideSuite)
+		}
 		if job == nil {
 			r.mu.Unlock()
 			break
@@ -520,6 +683,7 @@ func (r *Runner) worker(backend *Backend, system *System) {
 			insideProject = true
 			if !r.options.Restore && !r.run(client, job, preparing, r.project, r.project.Prepare, r.project.Debug, &abend) {
 				r.add(&stats.ProjectPrepareError, job)
+				r.fetchArtifacts(client, job)
 				r.add(&stats.TaskAbort, job)
 				badProject = true
 				continue
@@ -528,38 +692,93 @@ func (r *Runner) worker(backend *Backend, system *System) {
 			insideBackend = true
 			if !r.options.Restore && !r.run(client, job, preparing, backend, backend.Prepare, backend.Debug, &abend) {
 				r.add(&stats.BackendPrepareError, job)
+				r.fetchArtifacts(client, job)
 				r.add(&stats.TaskAbort, job)
 				badProject = true
 				continue
 			}
+
+			if backend.Reset == "snapshot" && !r.options.Restore {
+				canReset = r.snapshotReset(client)
+			}
 		}
 
 		if insideSuite != job.Suite {
 			insideSuite = job.Suite
 			if !r.options.Restore && !r.run(client, job, preparing, job.Suite, job.Suite.Prepare, job.Suite.Debug, &abend) {
 				r.add(&stats.SuitePrepareError, job)
+				r.fetchArtifacts(client, job)
 				r.add(&stats.TaskAbort, job)
 				badSuite[job.Suite] = true
 				continue
 			}
 		}
 
-		debug := job.Debug()
-		if r.options.Restore {
-			// Do not prepare or execute.
-		} else if !r.options.Restore && !r.run(client, job, preparing, job, job.Prepare(), debug, &abend) {
-			r.add(&stats.TaskPrepareError, job)
-			r.add(&stats.TaskAbort, job)
-			debug = ""
-		} else if !r.options.Restore && r.run(client, job, executing, job, job.Task.Execute, debug, &abend) {
-			r.add(&stats.TaskDone, job)
-		} else if !r.options.Restore {
-			r.add(&stats.TaskError, job)
-			debug = ""
-		}
-		if !abend && !r.run(client, job, restoring, job, job.Restore(), debug, &abend) {
-			r.add(&stats.TaskRestoreError, job)
-			badProject = true
+		retries := r.retries(job)
+		for attempt := firstAttempt; ; attempt++ {
+			var prepareError, executeError, reset bool
+			start := time.Now()
+			debug := job.Debug()
+			if r.options.Restore {
+				// Do not prepare or execute.
+			} else if !r.run(client, job, preparing, job, job.Prepare(), debug, &abend) {
+				prepareError = true
+				debug = ""
+			} else if !r.run(client, job, executing, job, job.Task.Execute, debug, &abend) {
+				executeError = true
+				debug = ""
+			}
+			if executeError && r.options.Reuse {
+				r.snapshotFailure(client, job)
+			}
+			if !r.options.Restore {
+				r.fetchArtifacts(client, job)
+			}
+			if !abend && !r.run(client, job, restoring, job, job.Restore(), debug, &abend) {
+				r.add(&stats.TaskRestoreError, job)
+				if canReset && r.resetServer(client) {
+					// The suite must be prepared again.
+					insideSuite = nil
+					reset = true
+				} else {
+					badProject = true
+				}
+			}
+
+			if (prepareError || executeError) && !abend && !badProject && !reset && attempt < retries && r.tomb.Alive() {
+				printf("Retrying %s after failure (retry %d of %d)...", job, attempt+1, retries)
+				if !r.options.RetryFresh {
+					continue
+				}
+				if fresh := r.freshClient(client, backend, system); fresh != nil {
+					// Everything is prepared again on the fresh server.
+					client = fresh
+					insideProject, insideBackend, insideSuite = false, false, nil
+					badSuite = make(map[*Suite]bool)
+					canReset = false
+					retryJob, retryAttempt = job, attempt+1
+					break
+				}
+				printf("Cannot retry %s without a fresh server.", job)
+			}
+
+			if !r.options.Restore && !prepareError && !abend && !r.interactive() {
+				r.recordTiming(job, time.Since(start))
+			}
+
+			switch {
+			case r.options.Restore:
+			case prepareError:
+				r.add(&stats.TaskPrepareError, job)
+				r.add(&stats.TaskAbort, job)
+			case executeError:
+				r.add(&stats.TaskError, job)
+			case attempt > 0:
+				r.add(&stats.TaskFlaky, job)
+			default:
+				r.add(&stats.TaskDone, job)
+			}
+			break
 		}
 	}
 
@@ -591,6 +810,80 @@ func (r *Runner) worker(backend *Backend, system *System) {
 	}
 }
 
+// interactive returns whether scripts may be interrupted by a shell,
+// which makes their duration meaningless.
+func (r *Runner) interactive() bool {
+	o := r.options
+	return o.Debug || o.Shell || o.ShellBefore || o.ShellAfter
+}
+
+var snapshotName = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// snapshotFailure saves a snapshot of the server state right after job
+// failed, if the server supports it, so it may be inspected later.
+func (r *Runner) snapshotFailure(client Executor, job *Job) {
+	server := client.Server()
+	snapshotter, ok := server.(Snapshotter)
+	if !ok {
+		return
+	}
+	name := "failed-" + strings.Trim(snapshotName.ReplaceAllString(job.Name, "-"), "-")
+	printf("Saving snapshot %s of %s...", name, server)
+	if err := snapshotter.Snapshot(name); err != nil {
+		printf("Cannot save snapshot of %s: %v", server, err)
+	}
+}
+
+// resetSnapshot is the name of the snapshot saved right after the
+// project and backend are prepared, for backends using "reset: snapshot".
+const resetSnapshot = "spread-reset"
+
+// snapshotReset saves the snapshot used by resetServer, and returns
+// whether the server may be reset.
+func (r *Runner) snapshotReset(client Executor) bool {
+	server := client.Server()
+	snapshotter, ok := server.(Snapshotter)
+	if !ok {
+		printf("WARNING: %s cannot save snapshots, so it cannot be reset after restore errors.", server)
+		return false
+	}
+	printf("Saving snapshot of %s for resetting it...", server)
+	if err := snapshotter.Snapshot(resetSnapshot); err != nil {
+		printf("Cannot save snapshot of %s: %v", server, err)
+		return false
+	}
+	return true
+}
+
+// resetServer restores the snapshot saved by snapshotReset, so the
+// server is back to the state right after the project and backend
+// were prepared, and reconnects the client to it.
+func (r *Runner) resetServer(client Executor) bool {
+	server := client.Server()
+	printf("Resetting %s to its prepared state...", server)
+	if err := server.(Snapshotter).RestoreSnapshot(resetSnapshot); err != nil {
+		printf("Cannot reset %s: %v", server, err)
+		return false
+	}
+	if c, ok := client.(*Client); ok {
+		if err := c.reconnect(); err != nil {
+			printf("Cannot reset %s: %v", server, err)
+			return false
+		}
+	}
+	return true
+}
+
+// retries returns how many times job may be retried after failing,
+// which is the most of what the job and Options.Retries allow for.
+func (r *Runner) retries(job *Job) int {
+	retries := job.Retries()
+	if r.options.Retries > retries {
+		retries = r.options.Retries
+	}
+	return retries
+}
+
 func (r *Runner) pendingJobs() int {
 	n := 0
 	for _, job := range r.pending {
@@ -630,7 +923,23 @@ func (r *Runner) job(backend *Backend, system *System, suite *Suite) *Job {
 	return nil
 }
 
-func (r *Runner) client(backend *Backend, system *System) *Client {
+// freshClient allocates a new server for retrying a job and discards
+// the server of client, unless no new server could be allocated.
+func (r *Runner) freshClient(client Executor, backend *Backend, system *System) Executor {
+	fresh := r.client(backend, system, true)
+	if fresh == nil {
+		return nil
+	}
+	server := client.Server()
+	client.Close()
+	printf("Discarding %s...", server)
+	r.discardServer(server)
+	return fresh
+}
+
+// client returns a client connected to a reused or newly allocated
+// server for system, or only to a newly allocated one if fresh is set.
+func (r *Runner) client(backend *Backend, system *System, fresh bool) Executor {
 
 	retries := 0
 	for r.tomb.Alive() {
@@ -640,7 +949,10 @@ func (r *Runner) client(backend *Backend, system *System) *Client {
 		}
 		retries++
 
-		client := r.reuseServer(backend, system)
+		var client Executor
+		if !fresh {
+			client = r.reuseServer(backend, system)
+		}
 		reused := client != nil
 		if !reused {
 			client = r.allocateServer(backend, system)
@@ -649,6 +961,10 @@ func (r *Runner) client(backend *Backend, system *System) *Client {
 			}
 		}
 
+		if c, ok := client.(*Client); ok {
+			c.notify = r.event
+		}
+
 		server := client.Server()
 		send := true
 		if reused && r.options.Resend {
@@ -685,6 +1001,7 @@ func (r *Runner) client(backend *Backend, system *System) *Client {
 				client.Close()
 				continue
 			}
+			r.serverEvent(ContentSent, server)
 		} else {
 			printf("Reusing project data on %s...", server)
 		}
@@ -701,6 +1018,7 @@ func (r *Runner) discardServer(server Server) {
 	if err := r.reuse.Remove(server); err != nil {
 		printf("Error removing %s from reuse file: %v", server, err)
 	}
+	r.serverEvent(ServerDiscarded, server)
 	r.unreserve(server.Address())
 	r.mu.Lock()
 	for i, s := range r.servers {
@@ -712,7 +1030,56 @@ func (r *Runner) discardServer(server Server) {
 	r.mu.Unlock()
 }
 
-func (r *Runner) allocateServer(backend *Backend, system *System) *Client {
+// serverLister is implemented by providers that can tell which servers
+// they hold, whether or not spread is tracking them for reuse.
+type serverLister interface {
+	listServers() ([]listedServer, error)
+}
+
+// listedServer is a server reported by a serverLister.
+type listedServer struct {
+	System  string
+	Address string
+}
+
+// reportUntracked logs the servers that providers still hold but are not
+// tracked for reuse, such as those left behind by a crashed process.
+func (r *Runner) reportUntracked() {
+	for _, bname := range r.project.backendNames() {
+		lister, ok := r.providers[bname].(serverLister)
+		if !ok {
+			continue
+		}
+		servers, err := lister.listServers()
+		if err != nil {
+			printf("Cannot list servers of %s: %v", r.project.Backends[bname], err)
+			continue
+		}
+		for _, server := range servers {
+			if !r.tracked(bname, server.Address) {
+				printf("Server %s:%s at %s is not tracked for reuse by this process.", bname, server.System, server.Address)
+			}
+		}
+	}
+}
+
+// tracked returns whether the server of backend at address is held by
+// the runner or tracked in its reuse file.
+func (r *Runner) tracked(bname, address string) bool {
+	if r.reuse.hasAddress(bname, address) {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, server := range r.servers {
+		if server.System().Backend == bname && server.Address() == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runner) allocateServer(backend *Backend, system *System) Executor {
 	if r.options.Discard {
 		return nil
 	}
@@ -757,9 +1124,15 @@ Allocate:
 	// Must reserve before adding to reuse, otherwise it might end up used twice.
 	r.reserve(server.Address())
 
-	if err := r.reuse.Add(server, r.options.Password); err != nil {
+	// Servers with the run key installed don't need the password tracked.
+	rpassword := r.options.Password
+	if keyServer, ok := server.(KeyServer); ok && keyServer.KeyAuthorized() {
+		rpassword = ""
+	}
+	if err := r.reuse.Add(server, rpassword, r.keyPath()); err != nil {
 		printf("Error adding %s to reuse file: %v", server, err)
 	}
+	r.serverEvent(ServerAllocated, server)
 
 	r.mu.Lock()
 	if !r.allocated && !r.options.Reuse && r.options.ReusePid == 0 {
@@ -776,23 +1149,39 @@ Allocate:
 	retry = time.NewTicker(5 * time.Second)
 	defer retry.Stop()
 
-	username := system.Username
-	password := system.Password
+	// The server may define its own credentials, as pool hosts do.
+	username := server.System().Username
+	password := server.System().Password
 	if username == "" {
 		username = "root"
 	}
 	if password == "" {
 		password = r.options.Password
 	}
+	keys := []ssh.Signer{r.key}
+	if path := server.System().Key; path != "" {
+		key, err := readKey(path)
+		if err != nil {
+			printf("Discarding %s, cannot connect: %v", server, err)
+			r.discardServer(server)
+			return nil
+		}
+		keys = []ssh.Signer{key, r.key}
+	}
 
-	var client *Client
+	var client Executor
 Dial:
 	for {
 		lerr := err
-		client, err = Dial(server, username, password)
+		client, err = r.dial(server, username, password, r.knownHosts[backend.Name], keys)
 		if err == nil {
 			break
 		}
+		if _, ok := err.(*HostKeyError); ok {
+			printf("Discarding %s, cannot verify host key: %v", server, err)
+			r.discardServer(server)
+			return nil
+		}
 		if lerr == nil || lerr.Error() != err.Error() {
 			debugf("Cannot connect to %s: %v", server, err)
 		}
@@ -813,6 +1202,8 @@ Dial:
 		return nil
 	}
 
+	r.recordHostKey(client)
+
 	printf("Connected to %s at %s.", server, server.Address())
 	r.servers = append(r.servers, server)
 	return client
@@ -837,7 +1228,16 @@ func (r *Runner) reserve(addr string) bool {
 	return true
 }
 
-func (r *Runner) reuseServer(backend *Backend, system *System) *Client {
+// dial returns an executor for running scripts on server, which is
+// reached over SSH unless the server provides its own executor.
+func (r *Runner) dial(server Server, username, password string, hostKey ssh.HostKeyCallback, keys []ssh.Signer) (Executor, error) {
+	if eserver, ok := server.(ExecServer); ok {
+		return eserver.Executor()
+	}
+	return Dial(server, username, password, hostKey, keys...)
+}
+
+func (r *Runner) reuseServer(backend *Backend, system *System) Executor {
 	provider := r.providers[backend.Name]
 
 	for _, rsystem := range r.reuse.ReuseSystems(system) {
@@ -864,20 +1264,66 @@ func (r *Runner) reuseServer(backend *Backend, system *System) *Client {
 		if username == "" {
 			username = "root"
 		}
-		client, err := Dial(server, username, password)
+		var keys []ssh.Signer
+		if rsystem.Key == r.keyPath() {
+			keys = append(keys, r.key)
+		} else if rsystem.Key != "" {
+			key, err := readKey(rsystem.Key)
+			if err != nil {
+				printf("Discarding %s, cannot connect: %v", server, err)
+				r.discardServer(server)
+				continue
+			}
+			keys = append(keys, key)
+		}
+		hostKey := r.knownHosts[backend.Name]
+		if hostKey == nil && rsystem.HostKey != "" {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rsystem.HostKey))
+			if err != nil {
+				printf("Discarding %s, cannot parse host key: %v", server, err)
+				r.discardServer(server)
+				continue
+			}
+			hostKey = ssh.FixedHostKey(key)
+		}
+		client, err := r.dial(server, username, password, hostKey, keys)
+		if _, ok := err.(*HostKeyError); ok {
+			printf("Discarding %s, cannot verify host key: %v", server, err)
+			r.discardServer(server)
+			continue
+		}
 		if err != nil {
 			printf("Discarding %s, cannot connect: %v", server, err)
 			r.discardServer(server)
 			continue
 		}
+		// Servers tracked before host keys were recorded get theirs now.
+		if rsystem.HostKey == "" {
+			r.recordHostKey(client)
+		}
+		r.serverEvent(ServerReused, server)
 
 		return client
 	}
 	return nil
 }
 
+// recordHostKey records the host key of the server client is connected
+// to, so that it's verified when the server is reused.
+func (r *Runner) recordHostKey(client Executor) {
+	c, ok := client.(*Client)
+	if !ok {
+		return
+	}
+	hostKey := string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(c.HostKey())))
+	if err := r.reuse.SetHostKey(c.Server(), hostKey); err != nil {
+		printf("Error adding host key of %s to reuse file: %v", c.Server(), err)
+	}
+}
+
 type stats struct {
 	TaskDone            []*Job
+	TaskFlaky           []*Job
 	TaskError           []*Job
 	TaskAbort           []*Job
 	TaskPrepareError    []*Job
@@ -910,9 +1356,11 @@ func (s *stats) errorCount() int {
 }
 
 func (s *stats) log() {
-	printf("Successful tasks: %d", len(s.TaskDone))
+	printf("Successful tasks: %d", len(s.TaskDone)+len(s.TaskFlaky))
 	printf("Aborted tasks: %d", len(s.TaskAbort))
 
+	logNames(printf, "Flaky tasks", s.TaskFlaky, taskName)
+
 	logNames(printf, "Failed tasks", s.TaskError, taskName)
 	logNames(printf, "Failed task prepare", s.TaskPrepareError, taskName)
 	logNames(printf, "Failed task restore", s.TaskRestoreError, taskName)
@@ -963,7 +1411,7 @@ func filterDir(path string) (names []string, err error) {
 	}
 	var filtered []string
 	for _, name := range names {
-		if !strings.HasPrefix(name, ".spread-reuse.") {
+		if !strings.HasPrefix(name, ".spread-reuse.") && !strings.HasPrefix(name, ".spread-last-run.") && !strings.HasPrefix(name, ".spread-timings.") {
 			filtered = append(filtered, name)
 		}
 	}
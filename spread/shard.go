@@ -0,0 +1,125 @@
+package spread
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Shard partitions jobs into n shards deterministically, so that
+// independent spread invocations may each run one of them. The
+// partition depends only on the names of the jobs and on timings,
+// not on their ordering. Shards are balanced by the duration each
+// job is expected to take according to timings, which may be nil to
+// balance by job count instead. Jobs for the same backend, system,
+// and suite are kept in the same shard so that the suite is not
+// prepared needlessly on every shard, unless they alone are more than
+// a fair share of the work. The ordering of jobs within each shard is
+// preserved.
+func Shard(jobs []*Job, n int, timings *Timings) [][]*Job {
+	if n < 1 {
+		n = 1
+	}
+
+	sorted := make([]*Job, len(jobs))
+	copy(sorted, jobs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var total time.Duration
+	var keys []string
+	groups := make(map[string][]*Job)
+	expected := make(map[*Job]time.Duration, len(jobs))
+	for _, job := range sorted {
+		key := job.Backend.Name + ":" + job.System.Name + ":" + job.Suite.Name
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], job)
+		expected[job] = timings.Expected(job)
+		total += expected[job]
+	}
+	sort.Strings(keys)
+
+	type chunk struct {
+		jobs     []*Job
+		duration time.Duration
+	}
+
+	// Groups bigger than a fair share are split so that one large
+	// suite cannot leave all the other shards idle.
+	share := (total + time.Duration(n) - 1) / time.Duration(n)
+	var chunks []chunk
+	for _, key := range keys {
+		var c chunk
+		for _, job := range groups[key] {
+			if len(c.jobs) > 0 && c.duration+expected[job] > share {
+				chunks = append(chunks, c)
+				c = chunk{}
+			}
+			c.jobs = append(c.jobs, job)
+			c.duration += expected[job]
+		}
+		chunks = append(chunks, c)
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].duration > chunks[j].duration })
+
+	shardOf := make(map[*Job]int, len(jobs))
+	durations := make([]time.Duration, n)
+	for _, c := range chunks {
+		min := 0
+		for i := range durations {
+			if durations[i] < durations[min] {
+				min = i
+			}
+		}
+		for _, job := range c.jobs {
+			shardOf[job] = min
+		}
+		durations[min] += c.duration
+	}
+
+	shards := make([][]*Job, n)
+	for _, job := range jobs {
+		i := shardOf[job]
+		shards[i] = append(shards[i], job)
+	}
+	return shards
+}
+
+// Shards returns all the shards that the jobs selected by options are
+// partitioned into, as options.Shards defines and regardless of which
+// one options.Shard selects.
+func (p *Project) Shards(options *Options) ([][]*Job, error) {
+	all := *options
+	all.Shard, all.Shards = 0, 0
+	jobs, err := p.Jobs(&all)
+	if err != nil {
+		return nil, err
+	}
+	timings, err := shardTimings(options)
+	if err != nil {
+		return nil, err
+	}
+	return Shard(jobs, options.Shards, timings), nil
+}
+
+// shardTimings returns the timings for balancing the shards of a run.
+// Timings recorded locally differ across machines and runs, so only a
+// file explicitly shared among the shards is used.
+func shardTimings(options *Options) (*Timings, error) {
+	if options.ShardTimings == "" {
+		return nil, nil
+	}
+	return ReadTimingsFile(options.ShardTimings)
+}
+
+func shardJobs(jobs []*Job, shard, shards int, timings *Timings) ([]*Job, error) {
+	if shard < 1 || shard > shards {
+		return nil, fmt.Errorf("invalid shard %d/%d", shard, shards)
+	}
+	jobs = Shard(jobs, shards, timings)[shard-1]
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("shard %d/%d has no jobs", shard, shards)
+	}
+	return jobs, nil
+}
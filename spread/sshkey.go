@@ -0,0 +1,82 @@
+package spread
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// readKey reads the unencrypted private key at path.
+func readKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SSH key: %v", err)
+	}
+	key, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse SSH key %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// createKey generates a new private key and writes it to path, in a
+// format that is also understood by the ssh command line tool.
+func createKey(path string) (ssh.Signer, error) {
+	pkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate SSH key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(pkey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal SSH key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("cannot write SSH key: %v", err)
+	}
+	return ssh.NewSignerFromKey(pkey)
+}
+
+// authorizedKey returns the public part of key in the format used
+// in authorized_keys files.
+func authorizedKey(key ssh.Signer) string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key.PublicKey())))
+}
+
+// authorizeKeyScript returns a shell script that authorizes the
+// public key for root logins over SSH.
+func authorizeKeyScript(publicKey string) string {
+	return fmt.Sprintf("mkdir -p /root/.ssh && chmod 700 /root/.ssh && echo '%s' >> /root/.ssh/authorized_keys && chmod 600 /root/.ssh/authorized_keys", publicKey)
+}
+
+// tuneSSH prepares sshd on a freshly started system for spread, using
+// run to execute each command inside it. With publicKey set the key is
+// authorized for root logins and the password is neither set nor enabled
+// for logins, as images may forbid those. Otherwise root logins with
+// password are enabled.
+func tuneSSH(run func(args []string) ([]byte, error), password, publicKey string) error {
+	cmds := [][]string{{"/bin/bash", "-c", authorizeKeyScript(publicKey)}}
+	if publicKey == "" {
+		cmds = [][]string{
+			{"sed", "-i", `s/\(PermitRootLogin\|PasswordAuthentication\)\>.*/\1 yes/`, "/etc/ssh/sshd_config"},
+			{"/bin/bash", "-c", fmt.Sprintf("echo root:'%s' | chpasswd", password)},
+			{"killall", "-HUP", "sshd"},
+		}
+	}
+	for _, args := range cmds {
+		output, err := run(args)
+		if err != nil && args[0] != "killall" {
+			return outputErr(output, err)
+		}
+	}
+	return nil
+}
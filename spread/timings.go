@@ -0,0 +1,98 @@
+package spread
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const timingsFilename = ".spread-timings.yaml"
+
+// Timings holds how long jobs took to run in previous runs of a project,
+// in seconds and indexed by job name.
+type Timings struct {
+	Jobs map[string]float64
+}
+
+// ReadTimings reads the durations recorded for jobs in previous runs of
+// project. The result is empty if nothing was recorded yet.
+func ReadTimings(project *Project) (*Timings, error) {
+	filename := filepath.Join(project.Path, timingsFilename)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return &Timings{Jobs: make(map[string]float64)}, nil
+	}
+	return ReadTimingsFile(filename)
+}
+
+// ReadTimingsFile reads job durations from the given file, which has
+// the format of the timings file recorded in the project.
+func ReadTimingsFile(filename string) (*Timings, error) {
+	timings := &Timings{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read job timings: %v", err)
+	}
+	if err := yaml.Unmarshal(data, timings); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal job timings: %v", err)
+	}
+	if timings.Jobs == nil {
+		timings.Jobs = make(map[string]float64)
+	}
+	return timings, nil
+}
+
+// Expected returns how long job is expected to take to run. Jobs that
+// were never timed are expected to take the mean of the known durations,
+// and all jobs are expected to take one minute if nothing is known.
+func (t *Timings) Expected(job *Job) time.Duration {
+	if t == nil || len(t.Jobs) == 0 {
+		return time.Minute
+	}
+	seconds, ok := t.Jobs[job.Name]
+	if !ok {
+		for _, s := range t.Jobs {
+			seconds += s
+		}
+		seconds /= float64(len(t.Jobs))
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// sortLongestFirst sorts jobs so that the ones expected to take longer
+// come first, preserving the original ordering for equal durations.
+func (t *Timings) sortLongestFirst(jobs []*Job) {
+	expected := make(map[*Job]time.Duration, len(jobs))
+	for _, job := range jobs {
+		expected[job] = t.Expected(job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return expected[jobs[i]] > expected[jobs[j]] })
+}
+
+func (r *Runner) recordTiming(job *Job, duration time.Duration) {
+	r.mu.Lock()
+	r.timings.Jobs[job.Name] = duration.Round(time.Second / 10).Seconds()
+	r.mu.Unlock()
+}
+
+func (r *Runner) writeTimings() error {
+	r.mu.Lock()
+	data, err := yaml.Marshal(r.timings)
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("internal error: cannot marshal job timings: %v", err)
+	}
+	filename := filepath.Join(r.project.Path, timingsFilename)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("cannot write job timings: %v", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		os.Remove(filename + ".tmp")
+		return fmt.Errorf("cannot write job timings: %v", err)
+	}
+	return nil
+}